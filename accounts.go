@@ -19,20 +19,34 @@ type Balance struct {
 type Account struct {
 	ID            string  `json:"id"`
 	Name          string  `json:"name"`
+	Primary       bool    `json:"primary"`
 	Currency      string  `json:"currency"`
 	Balance       Balance `json:"balance"`        // Amount in Cryptocurrency
 	NativeBalance Balance `json:"native_balance"` // Amount in USD
 }
 
 type Transaction struct {
-	ID           string  `json:"id"`
-	Type         string  `json:"type"`
-	Status       string  `json:"status"`
-	Amount       Balance `json:"amount"`        // Amount in Cryptocurrency
-	NativeAmount Balance `json:"native_amount"` // Amount in USD
-	Description  string  `json:"description"`
-	CreatedAt    string  `json:"created_at"`
-	UpdatedAt    string  `json:"updated_at"`
+	ID           string              `json:"id"`
+	Type         string              `json:"type"`
+	Status       string              `json:"status"`
+	Amount       Balance             `json:"amount"`        // Amount in Cryptocurrency
+	NativeAmount Balance             `json:"native_amount"` // Amount in USD
+	Description  string              `json:"description"`
+	Network      *TransactionNetwork `json:"network"` // Only set for sends
+	CreatedAt    string              `json:"created_at"`
+	UpdatedAt    string              `json:"updated_at"`
+}
+
+type TransactionNetwork struct {
+	Status         string   `json:"status"`
+	Hash           string   `json:"hash"`
+	TransactionFee *Balance `json:"transaction_fee"`
+}
+
+// WithdrawOptions are optional parameters for Withdraw.
+type WithdrawOptions struct {
+	Fee            *Balance // Network fee to pay for sends to an address, coinbase picks one if unset
+	TwoFactorToken string   // Required when coinbase responds with two_factor_required
 }
 
 type Address struct {
@@ -44,8 +58,9 @@ type Address struct {
 	UpdatedAt string `json:"updated_at"`
 }
 
+// ListAccounts lists every account, following pagination.
 func (c *ApiKeyClient) ListAccounts() ([]*Account, error) {
-	code, body, err := c.Request("GET", "accounts", nil)
+	code, body, err := c.RequestAll("accounts")
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +116,46 @@ func (c *ApiKeyClient) CreateAccount(Name string) (*Account, error) {
 	return account, nil
 }
 
+// UpdateAccount renames the given account id.
+func (c *ApiKeyClient) UpdateAccount(id, name string) (*Account, error) {
+
+	code, body, err := c.Request("PUT", fmt.Sprintf("accounts/%s", id), map[string]string{"name": name})
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	account := &Account{}
+	err = json.Unmarshal(body, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// SetPrimaryAccount makes the given account id the user's primary account.
+func (c *ApiKeyClient) SetPrimaryAccount(id string) (*Account, error) {
+
+	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/primary", id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	account := &Account{}
+	err = json.Unmarshal(body, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
 func (c *ApiKeyClient) DeleteAccount(id string) error {
 
 	code, _, err := c.Request("DELETE", fmt.Sprintf("accounts/%s", id), nil)
@@ -115,6 +170,21 @@ func (c *ApiKeyClient) DeleteAccount(id string) error {
 	return nil
 }
 
+// SafeDeleteAccount deletes the given account id, refusing accounts with a non-zero balance so funds aren't lost by
+// accident.
+func (c *ApiKeyClient) SafeDeleteAccount(id string) error {
+
+	account, err := c.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	if account.Balance.Amount != 0 {
+		return fmt.Errorf("refusing to delete account %s with non-zero balance %s:%.8f", id, account.Balance.Currency, account.Balance.Amount)
+	}
+
+	return c.DeleteAccount(id)
+}
+
 // CreateAddress creates an address for the given account id, letting users deposit funds.
 func (c *ApiKeyClient) CreateAddress(id string) (*Address, error) {
 
@@ -138,6 +208,11 @@ func (c *ApiKeyClient) CreateAddress(id string) (*Address, error) {
 
 // Transfer moves funds between accounts. Use this when tipping users.
 func (c *ApiKeyClient) Transfer(from, to string, amount *Balance) (*Transaction, error) {
+	return c.TransferWithDescription(from, to, amount, "cointip transfer")
+}
+
+// TransferWithDescription moves funds between accounts, recording description on the transaction.
+func (c *ApiKeyClient) TransferWithDescription(from, to string, amount *Balance, description string) (*Transaction, error) {
 
 	if !(amount.Currency == CurrencyBTC || amount.Currency == CurrencyUSD) {
 		return nil, fmt.Errorf("invalid currency type: %s", amount.Currency)
@@ -148,7 +223,7 @@ func (c *ApiKeyClient) Transfer(from, to string, amount *Balance) (*Transaction,
 		"to":          to,
 		"amount":      fmt.Sprintf("%.8f", amount.Amount),
 		"currency":    amount.Currency,
-		"description": "cointip transfer",
+		"description": description,
 	}
 	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/transactions", from), params)
 	if err != nil {
@@ -169,7 +244,7 @@ func (c *ApiKeyClient) Transfer(from, to string, amount *Balance) (*Transaction,
 }
 
 // Withdraw sends funds from an account id to an external address, letting users pull funds from their tipjar.
-func (c *ApiKeyClient) Withdraw(from, to string, amount *Balance) (*Transaction, error) {
+func (c *ApiKeyClient) Withdraw(from, to string, amount *Balance, opts *WithdrawOptions) (*Transaction, error) {
 
 	if !(amount.Currency == CurrencyBTC || amount.Currency == CurrencyUSD) {
 		return nil, fmt.Errorf("invalid currency type: %s", amount.Currency)
@@ -182,7 +257,16 @@ func (c *ApiKeyClient) Withdraw(from, to string, amount *Balance) (*Transaction,
 		"currency":    amount.Currency,
 		"description": "cointip withdraw",
 	}
-	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/transactions", from), params)
+	headers := map[string]string{}
+	if opts != nil {
+		if opts.Fee != nil {
+			params["fee"] = fmt.Sprintf("%.8f", opts.Fee.Amount)
+		}
+		if opts.TwoFactorToken != "" {
+			headers["CB-2FA-TOKEN"] = opts.TwoFactorToken
+		}
+	}
+	code, body, err := c.RequestWithHeaders("POST", fmt.Sprintf("accounts/%s/transactions", from), params, headers)
 	if err != nil {
 		return nil, err
 	}
@@ -219,3 +303,100 @@ func (c *ApiKeyClient) GetTransaction(id, txID string) (*Transaction, error) {
 	}
 	return tx, nil
 }
+
+// ListTransactions lists the most recent transactions on the given account id, newest first. limit is at most 100.
+func (c *ApiKeyClient) ListTransactions(id string, limit int) ([]*Transaction, error) {
+
+	code, body, err := c.Request("GET", fmt.Sprintf("accounts/%s/transactions?limit=%d", id, limit), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	txs := []*Transaction{}
+	err = json.Unmarshal(body, &txs)
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// RequestMoney requests funds from an email address into the given account id.
+func (c *ApiKeyClient) RequestMoney(id, from string, amount *Balance, description string) (*Transaction, error) {
+
+	if !(amount.Currency == CurrencyBTC || amount.Currency == CurrencyUSD) {
+		return nil, fmt.Errorf("invalid currency type: %s", amount.Currency)
+	}
+
+	params := map[string]string{
+		"type":        "request",
+		"to":          from,
+		"amount":      fmt.Sprintf("%.8f", amount.Amount),
+		"currency":    amount.Currency,
+		"description": description,
+	}
+	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/transactions", id), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	tx := &Transaction{}
+	err = json.Unmarshal(body, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// ResendRequest re-sends the email for a pending money request.
+func (c *ApiKeyClient) ResendRequest(id, txID string) error {
+
+	code, _, err := c.Request("POST", fmt.Sprintf("accounts/%s/transactions/%s/resend", id, txID), nil)
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+
+	return nil
+}
+
+// CancelRequest cancels a pending money request.
+func (c *ApiKeyClient) CancelRequest(id, txID string) error {
+
+	code, _, err := c.Request("DELETE", fmt.Sprintf("accounts/%s/transactions/%s", id, txID), nil)
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+
+	return nil
+}
+
+// CompleteRequest pays a money request made to the user.
+func (c *ApiKeyClient) CompleteRequest(id, txID string) error {
+
+	code, _, err := c.Request("POST", fmt.Sprintf("accounts/%s/transactions/%s/complete", id, txID), nil)
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -26,9 +27,83 @@ type ApiKeyClient struct {
 	debug     bool
 }
 
+// Largest page size the API allows.
+const pageLimit = 100
+
+type Pagination struct {
+	EndingBefore  string `json:"ending_before"`
+	StartingAfter string `json:"starting_after"`
+	Limit         int    `json:"limit"`
+	Order         string `json:"order"`
+	PreviousURI   string `json:"previous_uri"`
+	NextURI       string `json:"next_uri"`
+}
+
 type Response struct {
 	Pagination json.RawMessage `json:"pagination"`
 	Data       json.RawMessage `json:"data"`
+	Errors     []APIError      `json:"errors"`
+}
+
+// https://developers.coinbase.com/api/v2#errors
+type APIError struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+}
+
+// Error is returned when the API responds with a list of errors.
+type Error struct {
+	StatusCode int
+	Errors     []APIError
+}
+
+func (e *Error) Error() string {
+	msgs := []string{}
+	for _, apiErr := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", apiErr.ID, apiErr.Message))
+	}
+	return fmt.Sprintf("coinbase error (status %d): %s", e.StatusCode, strings.Join(msgs, ", "))
+}
+
+// Has returns true if the API returned an error with the given id.
+func (e *Error) Has(id string) bool {
+	for _, apiErr := range e.Errors {
+		if apiErr.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Error ids we handle specially.
+const (
+	ErrorTwoFactorRequired = "two_factor_required"
+	ErrorValidation        = "validation_error"
+)
+
+// IsTwoFactorRequired returns true if the request has to be repeated with a two factor token.
+func IsTwoFactorRequired(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.Has(ErrorTwoFactorRequired)
+}
+
+// IsInsufficientFunds returns true if the account didn't have enough funds for the request.
+func IsInsufficientFunds(err error) bool {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	for _, e := range apiErr.Errors {
+		if e.ID == "insufficient_funds" {
+			return true
+		}
+		// Coinbase reports this as a plain validation error
+		if e.ID == ErrorValidation && strings.Contains(strings.ToLower(e.Message), "have that much") {
+			return true
+		}
+	}
+	return false
 }
 
 // APIKeyClient makes a coinbase client using API key auth.
@@ -55,7 +130,7 @@ func APIKeyClient(apiKey, apiSecret string) (*ApiKeyClient, error) {
 func (c *ApiKeyClient) authenticate(req *http.Request, endpoint string, params []byte) {
 
 	timestamp := fmt.Sprintf("%d", time.Now().UTC().Unix())
-	message := timestamp + req.Method + req.URL.Path + string(params)
+	message := timestamp + req.Method + req.URL.RequestURI() + string(params)
 
 	req.Header.Set("CB-ACCESS-KEY", c.apiKey)
 
@@ -71,6 +146,64 @@ func (c *ApiKeyClient) authenticate(req *http.Request, endpoint string, params [
 
 // Request makes an authenticated API request.
 func (c *ApiKeyClient) Request(method string, path string, params interface{}) (int, []byte, error) {
+	return c.RequestWithHeaders(method, path, params, nil)
+}
+
+// RequestWithHeaders makes an authenticated API request with extra headers, like CB-2FA-TOKEN.
+func (c *ApiKeyClient) RequestWithHeaders(method string, path string, params interface{}, headers map[string]string) (int, []byte, error) {
+	code, response, err := c.request(method, path, params, headers)
+	if err != nil {
+		return code, nil, err
+	}
+	return code, response.Data, nil
+}
+
+// RequestAll makes an authenticated GET request to a list endpoint, following pagination and returning the data of
+// every page as a single JSON array.
+func (c *ApiKeyClient) RequestAll(path string) (int, []byte, error) {
+	all := []json.RawMessage{}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path = fmt.Sprintf("%s%slimit=%d", path, sep, pageLimit)
+
+	for path != "" {
+		code, response, err := c.request("GET", path, nil, nil)
+		if err != nil {
+			return code, nil, err
+		}
+		if code != http.StatusOK {
+			return code, nil, nil
+		}
+
+		page := []json.RawMessage{}
+		err = json.Unmarshal(response.Data, &page)
+		if err != nil {
+			return 0, nil, err
+		}
+		all = append(all, page...)
+
+		pagination := &Pagination{}
+		if len(response.Pagination) > 0 {
+			err = json.Unmarshal(response.Pagination, pagination)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		// next_uri is absolute (/v2/accounts?...), paths are relative to the endpoint
+		path = strings.TrimPrefix(pagination.NextURI, "/v2/")
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, data, nil
+}
+
+func (c *ApiKeyClient) request(method string, path string, params interface{}, headers map[string]string) (int, *Response, error) {
 
 	endpoint := c.endpoint + path
 
@@ -88,6 +221,9 @@ func (c *ApiKeyClient) Request(method string, path string, params interface{}) (
 
 	request.Header.Set("User-Agent", "Cointip/v1")
 	request.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
 
 	if c.debug {
 		dump, _ := httputil.DumpRequest(request, true)
@@ -118,7 +254,9 @@ func (c *ApiKeyClient) Request(method string, path string, params interface{}) (
 		}
 	}
 
-	// TODO: Pagination
+	if resp.StatusCode >= 400 && len(response.Errors) > 0 {
+		return resp.StatusCode, nil, &Error{StatusCode: resp.StatusCode, Errors: response.Errors}
+	}
 
-	return resp.StatusCode, response.Data, nil
+	return resp.StatusCode, response, nil
 }
@@ -0,0 +1,118 @@
+package cointip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeRequest is a request the fake coinbase received.
+type fakeRequest struct {
+	Method string
+	Path   string
+	Params map[string]interface{}
+	Header http.Header
+}
+
+// fakeCoinbase records requests and answers them with respond, which returns a status and the data or errors to send.
+type fakeCoinbase struct {
+	lock     sync.Mutex
+	requests []*fakeRequest
+	respond  func(r *fakeRequest) (int, interface{})
+}
+
+func (f *fakeCoinbase) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r := &fakeRequest{Method: req.Method, Path: req.URL.Path, Header: req.Header}
+	json.Unmarshal(body, &r.Params)
+
+	f.lock.Lock()
+	f.requests = append(f.requests, r)
+	f.lock.Unlock()
+
+	code, data := f.respond(r)
+	response := map[string]interface{}{"data": data}
+	if errs, ok := data.([]APIError); ok {
+		response = map[string]interface{}{"errors": errs}
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// newTestClient returns a client talking to a fake coinbase.
+func newTestClient(t *testing.T, respond func(r *fakeRequest) (int, interface{})) (*ApiKeyClient, *fakeCoinbase) {
+	t.Helper()
+	fake := &fakeCoinbase{respond: respond}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	c, err := APIKeyClient("key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.endpoint = server.URL + "/v2/"
+	return c, fake
+}
+
+func TestWithdrawTwoFactorRetry(t *testing.T) {
+	c, fake := newTestClient(t, func(r *fakeRequest) (int, interface{}) {
+		if r.Header.Get("CB-2FA-TOKEN") != "123456" {
+			return http.StatusPaymentRequired, []APIError{{ID: ErrorTwoFactorRequired, Message: "Two-step verification code required"}}
+		}
+		return http.StatusCreated, &Transaction{ID: "tx-1", Type: "send", Status: "pending"}
+	})
+
+	amount := &Balance{Currency: CurrencyBTC, Amount: 0.01}
+	fee := &Balance{Currency: CurrencyBTC, Amount: 0.0001}
+	_, err := c.Withdraw("acct-1", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", amount, &WithdrawOptions{Fee: fee})
+	if !IsTwoFactorRequired(err) {
+		t.Fatalf("got %v, want two factor required", err)
+	}
+
+	tx, err := c.Withdraw("acct-1", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", amount, &WithdrawOptions{Fee: fee, TwoFactorToken: "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.ID != "tx-1" || tx.Status != "pending" {
+		t.Fatalf("got %+v", tx)
+	}
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(fake.requests))
+	}
+	for _, r := range fake.requests {
+		if r.Method != "POST" || r.Path != "/v2/accounts/acct-1/transactions" {
+			t.Errorf("got %s %s", r.Method, r.Path)
+		}
+		if r.Params["type"] != "send" || r.Params["amount"] != "0.01000000" || r.Params["fee"] != "0.00010000" {
+			t.Errorf("got params %v", r.Params)
+		}
+	}
+}
+
+func TestWithdrawInsufficientFunds(t *testing.T) {
+	c, _ := newTestClient(t, func(r *fakeRequest) (int, interface{}) {
+		return http.StatusBadRequest, []APIError{{ID: ErrorValidation, Message: "You don't have that much."}}
+	})
+
+	_, err := c.Withdraw("acct-1", "someone@example.com", &Balance{Currency: CurrencyUSD, Amount: 5}, nil)
+	if !IsInsufficientFunds(err) {
+		t.Fatalf("got %v, want insufficient funds", err)
+	}
+}
+
+func TestWithdrawRefusesOtherCurrencies(t *testing.T) {
+	c, fake := newTestClient(t, func(r *fakeRequest) (int, interface{}) {
+		return http.StatusCreated, &Transaction{ID: "tx-1"}
+	})
+
+	if _, err := c.Withdraw("acct-1", "someone@example.com", &Balance{Currency: "EUR", Amount: 5}, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("sent %d requests", len(fake.requests))
+	}
+}
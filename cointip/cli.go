@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	logger "log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli"
 
@@ -27,6 +37,25 @@ func printTransaction(tx *cointip.Transaction) {
 		tx.NativeAmount.Currency, tx.NativeAmount.Amount)
 }
 
+func printOrder(order *cointip.Order) {
+	log.Printf(
+		"%s %s committed:%t amount:%s:%.8f subtotal:%s:%.2f fee:%s:%.2f total:%s:%.2f\n",
+		order.ID, order.Status, order.Committed, order.Amount.Currency, order.Amount.Amount,
+		order.Subtotal.Currency, order.Subtotal.Amount, order.Fee.Currency, order.Fee.Amount,
+		order.Total.Currency, order.Total.Amount)
+}
+
+// confirm asks a yes/no question on stdin.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func makeClient(ctx *cli.Context) *cointip.ApiKeyClient {
 
 	if apiKey == "" {
@@ -71,10 +100,19 @@ func main() {
 		GetAccount,
 		CreateAccount,
 		DeleteAccount,
+		RenameAccount,
+		SetPrimary,
 		CreateAddress,
 		Transfer,
 		Withdraw,
 		GetTransaction,
+		ListPaymentMethods,
+		Buy,
+		Sell,
+		Fund,
+		WhoAmI,
+		ListenNotifications,
+		PostNotification,
 	}
 
 	err := app.Run(os.Args)
@@ -148,6 +186,16 @@ var CreateAccount = cli.Command{
 var DeleteAccount = cli.Command{
 	Name:  "delete-account",
 	Usage: "Delete account",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Delete the account even if it has a non-zero balance",
+		},
+		cli.BoolFlag{
+			Name:  "yes",
+			Usage: "Don't ask for confirmation",
+		},
+	},
 	Action: func(ctx *cli.Context) error {
 		c := makeClient(ctx)
 
@@ -157,7 +205,23 @@ var DeleteAccount = cli.Command{
 
 		accountID := ctx.Args()[0]
 
-		err := c.DeleteAccount(accountID)
+		if !ctx.Bool("yes") {
+			account, err := c.GetAccount(accountID)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+			printAccount(account)
+			if !confirm("Really delete this account?") {
+				log.Fatal("Aborted")
+			}
+		}
+
+		var err error
+		if ctx.Bool("force") {
+			err = c.DeleteAccount(accountID)
+		} else {
+			err = c.SafeDeleteAccount(accountID)
+		}
 		if err != nil {
 			log.Fatalf("Error: %s", err)
 		}
@@ -167,6 +231,51 @@ var DeleteAccount = cli.Command{
 	},
 }
 
+var RenameAccount = cli.Command{
+	Name:  "rename-account",
+	Usage: "Rename account",
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+
+		if len(ctx.Args()) != 2 {
+			log.Fatal("Missing required argument(s): AccountID 'Account Name'")
+		}
+
+		accountID := ctx.Args()[0]
+		accountName := ctx.Args()[1]
+
+		account, err := c.UpdateAccount(accountID, accountName)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		printAccount(account)
+
+		return nil
+	},
+}
+
+var SetPrimary = cli.Command{
+	Name:  "set-primary",
+	Usage: "Set the primary account",
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+
+		if len(ctx.Args()) != 1 {
+			log.Fatal("Missing required argument: AccountID")
+		}
+
+		accountID := ctx.Args()[0]
+
+		account, err := c.SetPrimaryAccount(accountID)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		printAccount(account)
+
+		return nil
+	},
+}
+
 var CreateAddress = cli.Command{
 	Name:  "create-address",
 	Usage: "Create an address for receiving funds",
@@ -262,6 +371,14 @@ var Withdraw = cli.Command{
 			Name:  "amount",
 			Usage: "Amount to transfer",
 		},
+		cli.Float64Flag{
+			Name:  "fee",
+			Usage: "BTC network fee to pay, coinbase picks one if unset",
+		},
+		cli.StringFlag{
+			Name:  "2fa-token",
+			Usage: "Two factor token, if coinbase asks for one",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		c := makeClient(ctx)
@@ -284,7 +401,12 @@ var Withdraw = cli.Command{
 		currency := ctx.String("currency")
 		amount := ctx.Float64("amount")
 
-		tx, err := c.Withdraw(from, to, &cointip.Balance{Amount: amount, Currency: currency})
+		opts := &cointip.WithdrawOptions{TwoFactorToken: ctx.String("2fa-token")}
+		if ctx.IsSet("fee") {
+			opts.Fee = &cointip.Balance{Amount: ctx.Float64("fee"), Currency: cointip.CurrencyBTC}
+		}
+
+		tx, err := c.Withdraw(from, to, &cointip.Balance{Amount: amount, Currency: currency}, opts)
 		if err != nil {
 			log.Fatalf("Error: %s", err)
 		}
@@ -318,3 +440,309 @@ var GetTransaction = cli.Command{
 		return nil
 	},
 }
+
+var WhoAmI = cli.Command{
+	Name:  "whoami",
+	Usage: "Show the user and scopes of the API key",
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+
+		user, err := c.GetUser()
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		log.Printf("user: %s %s (%s)\n", user.ID, user.Name, user.Email)
+
+		auth, err := c.GetAuth()
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		log.Printf("auth: %s\n", auth.Method)
+		for _, scope := range auth.Scopes {
+			log.Printf("scope: %s\n", scope)
+		}
+
+		for _, scope := range auth.MissingScopes(cointip.TipScopes) {
+			log.Printf("missing scope for tipping: %s\n", scope)
+		}
+		for _, scope := range auth.MissingScopes(cointip.WithdrawScopes) {
+			log.Printf("missing scope for withdrawing: %s\n", scope)
+		}
+
+		return nil
+	},
+}
+
+var ListPaymentMethods = cli.Command{
+	Name:  "list-payment-methods",
+	Usage: "List linked payment methods",
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+
+		methods, err := c.ListPaymentMethods()
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		for _, method := range methods {
+			log.Printf(
+				"%s %s %s %s buy:%t sell:%t deposit:%t withdraw:%t\n",
+				method.ID, method.Name, method.Type, method.Currency,
+				method.AllowBuy, method.AllowSell, method.AllowDeposit, method.AllowWithdraw)
+		}
+
+		return nil
+	},
+}
+
+var orderFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "account",
+		Usage: "Account ID to buy into, sell from or fund",
+	},
+	cli.StringFlag{
+		Name:  "payment-method",
+		Usage: "Payment method ID to pay with or pay out to",
+	},
+	cli.StringFlag{
+		Name:  "currency",
+		Usage: "Currency type of the amount",
+	},
+	cli.Float64Flag{
+		Name:  "amount",
+		Usage: "Amount to buy, sell or fund",
+	},
+	cli.BoolFlag{
+		Name:  "yes",
+		Usage: "Commit the quote without asking for confirmation",
+	},
+}
+
+type createOrderFunc func(id, paymentMethod string, amount *cointip.Balance, commit bool) (*cointip.Order, error)
+type commitOrderFunc func(id, orderID string) (*cointip.Order, error)
+
+// runOrder quotes an order, shows it, and commits it once confirmed.
+func runOrder(ctx *cli.Context, create createOrderFunc, commit commitOrderFunc) {
+
+	if !ctx.IsSet("account") {
+		log.Fatal("Missing required flag: --account")
+	}
+	if !ctx.IsSet("payment-method") {
+		log.Fatal("Missing required flag: --payment-method")
+	}
+	if !ctx.IsSet("currency") {
+		log.Fatal("Missing required flag: --currency")
+	}
+	if !ctx.IsSet("amount") {
+		log.Fatal("Missing required flag: --amount")
+	}
+
+	account := ctx.String("account")
+	paymentMethod := ctx.String("payment-method")
+	currency := ctx.String("currency")
+	amount := ctx.Float64("amount")
+
+	quote, err := create(account, paymentMethod, &cointip.Balance{Amount: amount, Currency: currency}, false)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	printOrder(quote)
+
+	if !ctx.Bool("yes") && !confirm("Commit?") {
+		log.Fatal("Aborted")
+	}
+
+	order, err := commit(account, quote.ID)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	printOrder(order)
+}
+
+var Buy = cli.Command{
+	Name:  "buy",
+	Usage: "Buy crypto into an account from a payment method",
+	Flags: orderFlags,
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+		runOrder(ctx, c.CreateBuy, c.CommitBuy)
+		return nil
+	},
+}
+
+var Sell = cli.Command{
+	Name:  "sell",
+	Usage: "Sell crypto from an account to a payment method",
+	Flags: orderFlags,
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+		runOrder(ctx, c.CreateSell, c.CommitSell)
+		return nil
+	},
+}
+
+var Fund = cli.Command{
+	Name:  "fund",
+	Usage: "Deposit fiat into an account from a payment method",
+	Flags: orderFlags,
+	Action: func(ctx *cli.Context) error {
+		c := makeClient(ctx)
+		runOrder(ctx, c.CreateDeposit, c.CommitDeposit)
+		return nil
+	},
+}
+
+var ListenNotifications = cli.Command{
+	Name:  "listen-notifications",
+	Usage: "Receive coinbase notifications and print them",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "addr",
+			Usage: "Address to listen on",
+			Value: ":8080",
+		},
+		cli.StringFlag{
+			Name:  "public-key",
+			Usage: "PEM file with the key notifications are signed with (https://www.coinbase.com/coinbase.pub)",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+
+		if !ctx.IsSet("public-key") {
+			log.Fatal("Missing required flag: --public-key")
+		}
+
+		key, err := ioutil.ReadFile(ctx.String("public-key"))
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+
+		handler, err := cointip.NewNotificationHandler(key)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		handler.OnNotification(func(n *cointip.Notification) {
+			log.Printf("%s %s account:%s\n", n.ID, n.Type, n.Account.ID)
+		})
+		handler.OnNewPayment(func(e *cointip.NewPaymentEvent) {
+			log.Printf("new payment %s %s:%.8f hash:%s\n", e.Address.Address, e.Amount.Currency, e.Amount.Amount, e.Hash)
+		})
+		handler.OnTransaction(func(e *cointip.TransactionEvent) {
+			printTransaction(e.Transaction)
+		})
+
+		log.Printf("listening on %s\n", ctx.String("addr"))
+		return http.ListenAndServe(ctx.String("addr"), handler)
+	},
+}
+
+// readPrivateKey reads a PKCS1 or PKCS8 PEM encoded RSA key.
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected RSA key in %s, got %T", path, key)
+	}
+	return rsaKey, nil
+}
+
+var PostNotification = cli.Command{
+	Name:  "post-notification",
+	Usage: "Post a signed sample notification to a local listener",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "URL to post to",
+			Value: "http://localhost:8080/",
+		},
+		cli.StringFlag{
+			Name:  "private-key",
+			Usage: "PEM file with the key to sign with",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "Notification type",
+			Value: cointip.NotificationNewPayment,
+		},
+		cli.StringFlag{
+			Name:  "account",
+			Usage: "Account ID the notification is for",
+		},
+		cli.StringFlag{
+			Name:  "currency",
+			Usage: "Currency type of the payment",
+			Value: cointip.CurrencyBTC,
+		},
+		cli.Float64Flag{
+			Name:  "amount",
+			Usage: "Amount of the payment",
+			Value: 0.001,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+
+		if !ctx.IsSet("private-key") {
+			log.Fatal("Missing required flag: --private-key")
+		}
+
+		key, err := readPrivateKey(ctx.String("private-key"))
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		amount := cointip.Balance{Amount: ctx.Float64("amount"), Currency: ctx.String("currency")}
+		notification := &cointip.Notification{
+			ID:        fmt.Sprintf("sample-%d", time.Now().UnixNano()),
+			Type:      ctx.String("type"),
+			Account:   cointip.Resource{ID: ctx.String("account"), Resource: "account"},
+			CreatedAt: now,
+		}
+
+		var data, additionalData interface{}
+		if notification.Type == cointip.NotificationNewPayment {
+			data = &cointip.Address{ID: "sample-address", Address: "sample-address", CreatedAt: now, UpdatedAt: now}
+			additionalData = map[string]interface{}{
+				"hash":        "sample-hash",
+				"amount":      amount,
+				"transaction": cointip.Resource{ID: "sample-transaction", Resource: "transaction"},
+			}
+		} else {
+			data = &cointip.Transaction{ID: "sample-transaction", Type: "send", Status: "completed", Amount: amount, CreatedAt: now, UpdatedAt: now}
+		}
+
+		notification.Data, err = json.Marshal(data)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		if additionalData != nil {
+			notification.AdditionalData, err = json.Marshal(additionalData)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+		}
+
+		code, err := cointip.PostNotification(ctx.String("url"), key, notification)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		log.Printf("%s %s %d\n", notification.ID, notification.Type, code)
+
+		return nil
+	},
+}
@@ -0,0 +1,238 @@
+package cointip
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Notification types we decode into typed events.
+const (
+	NotificationNewPayment         = "wallet:addresses:new-payment"
+	NotificationTransactionsPrefix = "wallet:transactions:"
+)
+
+// Coinbase signs notification bodies with its private key and sends the base64 signature in this header.
+const notificationSignatureHeader = "CB-SIGNATURE"
+
+// Don't read arbitrarily large bodies from the internet.
+const maxNotificationSize = 1 << 20
+
+// https://developers.coinbase.com/api/v2#notifications
+type Notification struct {
+	ID               string          `json:"id"`
+	Type             string          `json:"type"`
+	Data             json.RawMessage `json:"data"`
+	User             Resource        `json:"user"`
+	Account          Resource        `json:"account"`
+	AdditionalData   json.RawMessage `json:"additional_data"`
+	DeliveryAttempts int             `json:"delivery_attempts"`
+	CreatedAt        string          `json:"created_at"`
+}
+
+// NewPaymentEvent is sent when funds arrive at one of an account's addresses.
+type NewPaymentEvent struct {
+	Notification *Notification `json:"-"`
+	Address      *Address      `json:"-"`
+	Amount       Balance       `json:"amount"`
+	Hash         string        `json:"hash"`
+	Transaction  Resource      `json:"transaction"`
+}
+
+// TransactionEvent is sent when a transaction on an account is created or changes state.
+type TransactionEvent struct {
+	Notification *Notification
+	Transaction  *Transaction
+}
+
+type NotificationFunc func(*Notification)
+type NewPaymentFunc func(*NewPaymentEvent)
+type TransactionFunc func(*TransactionEvent)
+
+// NotificationHandler is an http.Handler that receives coinbase notifications, verifies their signature and
+// dispatches them to the registered handlers.
+type NotificationHandler struct {
+	publicKey *rsa.PublicKey
+
+	lock        sync.RWMutex
+	raw         []NotificationFunc
+	newPayment  []NewPaymentFunc
+	transaction []TransactionFunc
+}
+
+// NewNotificationHandler makes a handler that verifies notifications against the given PEM encoded public key.
+// The coinbase key is published at https://www.coinbase.com/coinbase.pub
+func NewNotificationHandler(publicKeyPEM []byte) (*NotificationHandler, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid notification public key: no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid notification public key: expected RSA, got %T", key)
+	}
+
+	return &NotificationHandler{
+		publicKey: publicKey,
+	}, nil
+}
+
+// OnNotification registers a handler for every verified notification, including types without a typed event.
+func (h *NotificationHandler) OnNotification(fn NotificationFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.raw = append(h.raw, fn)
+}
+
+// OnNewPayment registers a handler for wallet:addresses:new-payment notifications.
+func (h *NotificationHandler) OnNewPayment(fn NewPaymentFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.newPayment = append(h.newPayment, fn)
+}
+
+// OnTransaction registers a handler for wallet:transactions:* notifications.
+func (h *NotificationHandler) OnTransaction(fn TransactionFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.transaction = append(h.transaction, fn)
+}
+
+// Verify checks the base64 signature of a notification body.
+func (h *NotificationHandler) Verify(body []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid notification signature encoding: %s", err)
+	}
+
+	hashed := sha256.Sum256(body)
+	return rsa.VerifyPKCS1v15(h.publicKey, crypto.SHA256, hashed[:], sig)
+}
+
+func (h *NotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxNotificationSize))
+	if err != nil {
+		http.Error(w, "failed reading body", http.StatusBadRequest)
+		return
+	}
+
+	err = h.Verify(body, r.Header.Get(notificationSignatureHeader))
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	notification := &Notification{}
+	err = json.Unmarshal(body, notification)
+	if err != nil {
+		http.Error(w, "invalid notification", http.StatusBadRequest)
+		return
+	}
+
+	err = h.dispatch(notification)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *NotificationHandler) dispatch(notification *Notification) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	switch {
+	case notification.Type == NotificationNewPayment:
+		event := &NewPaymentEvent{Notification: notification, Address: &Address{}}
+		if len(notification.AdditionalData) > 0 {
+			err := json.Unmarshal(notification.AdditionalData, event)
+			if err != nil {
+				return fmt.Errorf("invalid new-payment additional_data: %s", err)
+			}
+		}
+		err := json.Unmarshal(notification.Data, event.Address)
+		if err != nil {
+			return fmt.Errorf("invalid new-payment data: %s", err)
+		}
+		for _, fn := range h.newPayment {
+			fn(event)
+		}
+	case strings.HasPrefix(notification.Type, NotificationTransactionsPrefix):
+		event := &TransactionEvent{Notification: notification, Transaction: &Transaction{}}
+		err := json.Unmarshal(notification.Data, event.Transaction)
+		if err != nil {
+			return fmt.Errorf("invalid transaction data: %s", err)
+		}
+		for _, fn := range h.transaction {
+			fn(event)
+		}
+	}
+
+	for _, fn := range h.raw {
+		fn(notification)
+	}
+
+	return nil
+}
+
+// SignNotification signs a notification body the way coinbase does, for posting sample notifications to a local
+// handler during testing.
+func SignNotification(privateKey *rsa.PrivateKey, body []byte) (string, error) {
+	hashed := sha256.Sum256(body)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// PostNotification posts a signed notification to url.
+func PostNotification(url string, privateKey *rsa.PrivateKey, notification *Notification) (int, error) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return 0, err
+	}
+
+	signature, err := SignNotification(privateKey, body)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(notificationSignatureHeader, signature)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,262 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Resource is a reference to another API object.
+type Resource struct {
+	ID           string `json:"id"`
+	Resource     string `json:"resource"`
+	ResourcePath string `json:"resource_path"`
+}
+
+type PaymentMethod struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	Currency      string `json:"currency"`
+	PrimaryBuy    bool   `json:"primary_buy"`
+	PrimarySell   bool   `json:"primary_sell"`
+	AllowBuy      bool   `json:"allow_buy"`
+	AllowSell     bool   `json:"allow_sell"`
+	AllowDeposit  bool   `json:"allow_deposit"`
+	AllowWithdraw bool   `json:"allow_withdraw"`
+	InstantBuy    bool   `json:"instant_buy"`
+	InstantSell   bool   `json:"instant_sell"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+}
+
+// Order is a buy, sell, deposit or withdrawal. They all share the same shape. Orders created without committing are
+// quotes that can be inspected (fees, totals) and committed later.
+type Order struct {
+	ID            string   `json:"id"`
+	Status        string   `json:"status"`
+	PaymentMethod Resource `json:"payment_method"`
+	Transaction   Resource `json:"transaction"`
+	Amount        Balance  `json:"amount"`
+	Total         Balance  `json:"total"`
+	Subtotal      Balance  `json:"subtotal"`
+	Fee           Balance  `json:"fee"`
+	Committed     bool     `json:"committed"`
+	Instant       bool     `json:"instant"`
+	PayoutAt      string   `json:"payout_at"`
+	CreatedAt     string   `json:"created_at"`
+	UpdatedAt     string   `json:"updated_at"`
+}
+
+const (
+	orderBuys        = "buys"
+	orderSells       = "sells"
+	orderDeposits    = "deposits"
+	orderWithdrawals = "withdrawals"
+)
+
+// ListPaymentMethods lists the payment methods (bank accounts, cards, fiat wallets) linked to the user.
+func (c *ApiKeyClient) ListPaymentMethods() ([]*PaymentMethod, error) {
+
+	code, body, err := c.Request("GET", "payment-methods", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	methods := []*PaymentMethod{}
+	err = json.Unmarshal(body, &methods)
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// GetPaymentMethod returns a given payment method by id.
+func (c *ApiKeyClient) GetPaymentMethod(id string) (*PaymentMethod, error) {
+
+	code, body, err := c.Request("GET", fmt.Sprintf("payment-methods/%s", id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	method := &PaymentMethod{}
+	err = json.Unmarshal(body, method)
+	if err != nil {
+		return nil, err
+	}
+	return method, nil
+}
+
+func (c *ApiKeyClient) createOrder(kind, id, paymentMethod string, amount *Balance, commit bool) (*Order, error) {
+
+	params := map[string]interface{}{
+		"amount":         fmt.Sprintf("%.8f", amount.Amount),
+		"currency":       amount.Currency,
+		"payment_method": paymentMethod,
+		"commit":         commit,
+	}
+	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/%s", id, kind), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	order := &Order{}
+	err = json.Unmarshal(body, order)
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (c *ApiKeyClient) commitOrder(kind, id, orderID string) (*Order, error) {
+
+	code, body, err := c.Request("POST", fmt.Sprintf("accounts/%s/%s/%s/commit", id, kind, orderID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	order := &Order{}
+	err = json.Unmarshal(body, order)
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (c *ApiKeyClient) getOrder(kind, id, orderID string) (*Order, error) {
+
+	code, body, err := c.Request("GET", fmt.Sprintf("accounts/%s/%s/%s", id, kind, orderID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	order := &Order{}
+	err = json.Unmarshal(body, order)
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (c *ApiKeyClient) listOrders(kind, id string) ([]*Order, error) {
+
+	code, body, err := c.Request("GET", fmt.Sprintf("accounts/%s/%s", id, kind), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	orders := []*Order{}
+	err = json.Unmarshal(body, &orders)
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// CreateBuy buys crypto into the given account id using a payment method. If commit is false the buy is only a quote
+// and must be committed with CommitBuy.
+func (c *ApiKeyClient) CreateBuy(id, paymentMethod string, amount *Balance, commit bool) (*Order, error) {
+	return c.createOrder(orderBuys, id, paymentMethod, amount, commit)
+}
+
+// CommitBuy completes a previously quoted buy.
+func (c *ApiKeyClient) CommitBuy(id, buyID string) (*Order, error) {
+	return c.commitOrder(orderBuys, id, buyID)
+}
+
+// GetBuy returns a given buy by id.
+func (c *ApiKeyClient) GetBuy(id, buyID string) (*Order, error) {
+	return c.getOrder(orderBuys, id, buyID)
+}
+
+// ListBuys lists buys for the given account id.
+func (c *ApiKeyClient) ListBuys(id string) ([]*Order, error) {
+	return c.listOrders(orderBuys, id)
+}
+
+// CreateSell sells crypto from the given account id into a payment method. If commit is false the sell is only a
+// quote and must be committed with CommitSell.
+func (c *ApiKeyClient) CreateSell(id, paymentMethod string, amount *Balance, commit bool) (*Order, error) {
+	return c.createOrder(orderSells, id, paymentMethod, amount, commit)
+}
+
+// CommitSell completes a previously quoted sell.
+func (c *ApiKeyClient) CommitSell(id, sellID string) (*Order, error) {
+	return c.commitOrder(orderSells, id, sellID)
+}
+
+// GetSell returns a given sell by id.
+func (c *ApiKeyClient) GetSell(id, sellID string) (*Order, error) {
+	return c.getOrder(orderSells, id, sellID)
+}
+
+// ListSells lists sells for the given account id.
+func (c *ApiKeyClient) ListSells(id string) ([]*Order, error) {
+	return c.listOrders(orderSells, id)
+}
+
+// CreateDeposit deposits fiat from a payment method into the given fiat account id. If commit is false the deposit
+// must be committed with CommitDeposit.
+func (c *ApiKeyClient) CreateDeposit(id, paymentMethod string, amount *Balance, commit bool) (*Order, error) {
+	return c.createOrder(orderDeposits, id, paymentMethod, amount, commit)
+}
+
+// CommitDeposit completes a previously created deposit.
+func (c *ApiKeyClient) CommitDeposit(id, depositID string) (*Order, error) {
+	return c.commitOrder(orderDeposits, id, depositID)
+}
+
+// GetDeposit returns a given deposit by id.
+func (c *ApiKeyClient) GetDeposit(id, depositID string) (*Order, error) {
+	return c.getOrder(orderDeposits, id, depositID)
+}
+
+// ListDeposits lists deposits for the given account id.
+func (c *ApiKeyClient) ListDeposits(id string) ([]*Order, error) {
+	return c.listOrders(orderDeposits, id)
+}
+
+// CreateWithdrawal withdraws fiat from the given fiat account id into a payment method. If commit is false the
+// withdrawal must be committed with CommitWithdrawal.
+func (c *ApiKeyClient) CreateWithdrawal(id, paymentMethod string, amount *Balance, commit bool) (*Order, error) {
+	return c.createOrder(orderWithdrawals, id, paymentMethod, amount, commit)
+}
+
+// CommitWithdrawal completes a previously created withdrawal.
+func (c *ApiKeyClient) CommitWithdrawal(id, withdrawalID string) (*Order, error) {
+	return c.commitOrder(orderWithdrawals, id, withdrawalID)
+}
+
+// GetWithdrawal returns a given withdrawal by id.
+func (c *ApiKeyClient) GetWithdrawal(id, withdrawalID string) (*Order, error) {
+	return c.getOrder(orderWithdrawals, id, withdrawalID)
+}
+
+// ListWithdrawals lists withdrawals for the given account id.
+func (c *ApiKeyClient) ListWithdrawals(id string) ([]*Order, error) {
+	return c.listOrders(orderWithdrawals, id)
+}
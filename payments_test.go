@@ -0,0 +1,106 @@
+package cointip
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOrderQuoteThenCommit(t *testing.T) {
+	tests := []struct {
+		kind   string
+		create func(c *ApiKeyClient, amount *Balance) (*Order, error)
+		commit func(c *ApiKeyClient, id string) (*Order, error)
+	}{
+		{
+			orderBuys,
+			func(c *ApiKeyClient, amount *Balance) (*Order, error) {
+				return c.CreateBuy("acct-1", "pm-1", amount, false)
+			},
+			func(c *ApiKeyClient, id string) (*Order, error) { return c.CommitBuy("acct-1", id) },
+		},
+		{
+			orderSells,
+			func(c *ApiKeyClient, amount *Balance) (*Order, error) {
+				return c.CreateSell("acct-1", "pm-1", amount, false)
+			},
+			func(c *ApiKeyClient, id string) (*Order, error) { return c.CommitSell("acct-1", id) },
+		},
+		{
+			orderDeposits,
+			func(c *ApiKeyClient, amount *Balance) (*Order, error) {
+				return c.CreateDeposit("acct-1", "pm-1", amount, false)
+			},
+			func(c *ApiKeyClient, id string) (*Order, error) { return c.CommitDeposit("acct-1", id) },
+		},
+		{
+			orderWithdrawals,
+			func(c *ApiKeyClient, amount *Balance) (*Order, error) {
+				return c.CreateWithdrawal("acct-1", "pm-1", amount, false)
+			},
+			func(c *ApiKeyClient, id string) (*Order, error) { return c.CommitWithdrawal("acct-1", id) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			c, fake := newTestClient(t, func(r *fakeRequest) (int, interface{}) {
+				order := &Order{
+					ID:     "order-1",
+					Status: "created",
+					Amount: Balance{Currency: CurrencyUSD, Amount: 10},
+					Fee:    Balance{Currency: CurrencyUSD, Amount: 0.15},
+					Total:  Balance{Currency: CurrencyUSD, Amount: 10.15},
+				}
+				if strings.HasSuffix(r.Path, "/commit") {
+					order.Status = "completed"
+					order.Committed = true
+					return http.StatusOK, order
+				}
+				return http.StatusCreated, order
+			})
+
+			quote, err := test.create(c, &Balance{Currency: CurrencyUSD, Amount: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quote.Committed || quote.Fee.Amount != 0.15 || quote.Total.Amount != 10.15 {
+				t.Fatalf("got quote %+v", quote)
+			}
+
+			order, err := test.commit(c, quote.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !order.Committed || order.Status != "completed" {
+				t.Fatalf("got order %+v", order)
+			}
+
+			if len(fake.requests) != 2 {
+				t.Fatalf("got %d requests, want 2", len(fake.requests))
+			}
+			create, commit := fake.requests[0], fake.requests[1]
+			if create.Method != "POST" || create.Path != "/v2/accounts/acct-1/"+test.kind {
+				t.Errorf("quote sent %s %s", create.Method, create.Path)
+			}
+			if create.Params["commit"] != false || create.Params["payment_method"] != "pm-1" || create.Params["amount"] != "10.00000000" {
+				t.Errorf("quote sent params %v", create.Params)
+			}
+			if commit.Method != "POST" || commit.Path != "/v2/accounts/acct-1/"+test.kind+"/order-1/commit" {
+				t.Errorf("commit sent %s %s", commit.Method, commit.Path)
+			}
+		})
+	}
+}
+
+func TestCommitFailure(t *testing.T) {
+	c, _ := newTestClient(t, func(r *fakeRequest) (int, interface{}) {
+		return http.StatusBadRequest, []APIError{{ID: "invalid_request", Message: "Quote expired"}}
+	})
+
+	_, err := c.CommitBuy("acct-1", "order-1")
+	apiErr, ok := err.(*Error)
+	if !ok || !apiErr.Has("invalid_request") {
+		t.Fatalf("got %v, want the API error", err)
+	}
+}
@@ -0,0 +1,409 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Frozen users can't tip or withdraw. Tips to them still land.
+const frozenBucket = "frozen"
+
+type frozen struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Refunds are claimed by the id of the tip they send back before they're sent, so a tip is only refunded once.
+const refundsBucket = "refunds"
+
+type refundClaim struct {
+	By       string    `json:"by"`
+	RefundId string    `json:"refund_id"` // Set once the refund is sent
+	Time     time.Time `json:"time"`
+}
+
+// adminCommands are /cointip admin <name> commands.
+var adminCommands = map[string]*subcommand{}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "admin",
+		Usage: "<command> [args...]",
+		Help:  "Manage the bot",
+		Admin: true,
+		Run:   (*Plugin).adminCommand,
+	})
+
+	for _, cmd := range []*subcommand{
+		{Name: "status", Help: "Show the bank and queue status", Run: (*Plugin).adminStatusCommand},
+		{Name: "user", Usage: "@user", Help: "Look up a user's tipjar", Run: (*Plugin).adminUserCommand},
+		{Name: "freeze", Usage: "@user [reason]", Help: "Stop a user from tipping and withdrawing", Run: (*Plugin).adminFreezeCommand},
+		{Name: "unfreeze", Usage: "@user", Help: "Let a frozen user tip and withdraw again", Run: (*Plugin).adminUnfreezeCommand},
+		{Name: "transfer", Usage: "<@user|bank> <@user|bank> <amount> [memo]", Help: "Move funds without limits", Run: (*Plugin).adminTransferCommand},
+		{Name: "refund", Usage: "<tip id>", Help: "Send a tip back to its sender", Run: (*Plugin).adminRefundCommand},
+		{Name: "reconcile", Help: "Settle the ledger and check it against coinbase", Run: (*Plugin).adminReconcileCommand},
+	} {
+		cmd.Name = "admin " + cmd.Name
+		adminCommands[strings.TrimPrefix(cmd.Name, "admin ")] = cmd
+	}
+}
+
+func (p *Plugin) isAdmin(userId string) bool {
+	return p.admins[userId]
+}
+
+// checkFrozen refuses anything a frozen user tries to send.
+func (p *Plugin) checkFrozen(userId string) error {
+	value, err := p.store.Get(frozenBucket, userId)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		return refuse("your tipjar is frozen, ask an admin")
+	}
+	return nil
+}
+
+// /cointip admin <command> [args...]
+func (p *Plugin) adminCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) > 0 {
+		if cmd, ok := adminCommands[strings.ToLower(args[0].Text)]; ok {
+			log.Infof("cointip: %s ran admin command %s", cmdMsg.Command.UserId, cmd.Name)
+			cmd.Run(p, cmdMsg, args[1:])
+			return
+		}
+	}
+
+	names := []string{}
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"cointip admin:"}
+	for _, name := range names {
+		cmd := adminCommands[name]
+		lines = append(lines, fmt.Sprintf("`%s` - %s", cmd.usageString(), cmd.Help))
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+func (p *Plugin) countBucket(bucket string) int {
+	count := 0
+	p.store.ForEach(bucket, func(key string, value []byte) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+// /cointip admin status
+func (p *Plugin) adminStatusCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	account, err := p.client.GetAccount(p.bankAccount.ID)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed fetching bank account")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	lines := []string{
+		fmt.Sprintf("bank: %s (%s) %s", account.Name, account.ID, accountBalanceString(account)),
+		fmt.Sprintf("accounts: %d frozen: %d", p.countAccounts(), p.countBucket(frozenBucket)),
+		fmt.Sprintf("queued tips: %d dead-lettered: %d", p.countBucket(tipJobsBucket), p.countBucket(tipJobsDeadBucket)),
+	}
+	if p.config.Priming != nil {
+		spent, _ := p.store.Get(metaBucket, primingSpentKey)
+		if spent == nil {
+			spent = []byte("0")
+		}
+		line := fmt.Sprintf("primed users: %d", p.countBucket(primedBucket))
+		if p.config.Priming.Budget > 0 {
+			line += fmt.Sprintf(" budget spent: %s of %.2f", string(spent), p.config.Priming.Budget)
+		}
+		lines = append(lines, line)
+	}
+	if p.config.Ledger {
+		if position := p.ledgerPositionString(ledgerSettlement); position != "" {
+			lines = append(lines, fmt.Sprintf("unsettled: %s", position))
+		}
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+// /cointip admin user @user
+func (p *Plugin) adminUserCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, adminCommands["user"])
+		return
+	}
+	userId, err := args[0].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	accountId, err := p.store.Get(accountsBucket, userId)
+	if err != nil {
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if accountId == nil {
+		say(cmdMsg, fmt.Sprintf("<@%s> doesn't have a tipjar", userId), false)
+		return
+	}
+
+	account, err := p.client.GetAccount(string(accountId))
+	if err != nil {
+		log.WithError(err).Error("cointip: failed fetching coinbase account")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	lines := []string{fmt.Sprintf("<@%s>: %s (%s) %s", userId, account.Name, account.ID, accountBalanceString(account))}
+	if p.config.Ledger {
+		if position := p.ledgerPositionString(userId); position != "" {
+			lines = append(lines, fmt.Sprintf("unsettled: %s", position))
+		}
+	}
+	if value, _ := p.store.Get(frozenBucket, userId); value != nil {
+		f := &frozen{}
+		json.Unmarshal(value, f)
+		lines = append(lines, fmt.Sprintf("frozen by <@%s> at %s: %s", f.By, f.Time.Format(time.RFC3339), f.Reason))
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+// /cointip admin freeze @user [reason]
+func (p *Plugin) adminFreezeCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) < 1 {
+		sayUsage(cmdMsg, adminCommands["freeze"])
+		return
+	}
+	userId, err := args[0].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	data, err := json.Marshal(&frozen{By: cmdMsg.Command.UserId, Reason: joinTokens(args[1:]), Time: time.Now().UTC()})
+	if err == nil {
+		err = p.store.Put(frozenBucket, userId, data)
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: failed freezing user")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	log.Infof("cointip: %s froze %s", cmdMsg.Command.UserId, userId)
+	say(cmdMsg, fmt.Sprintf("froze <@%s>", userId), false)
+}
+
+// /cointip admin unfreeze @user
+func (p *Plugin) adminUnfreezeCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, adminCommands["unfreeze"])
+		return
+	}
+	userId, err := args[0].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	err = p.store.Delete(frozenBucket, userId)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed unfreezing user")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	log.Infof("cointip: %s unfroze %s", cmdMsg.Command.UserId, userId)
+	say(cmdMsg, fmt.Sprintf("unfroze <@%s>", userId), false)
+}
+
+// adminParty resolves a transfer party, where "bank" is the bank account.
+func (p *Plugin) adminParty(cmdMsg *quadlek.CommandMsg, t *token) (string, error) {
+	if strings.ToLower(t.Text) == "bank" {
+		return p.bankUserId, nil
+	}
+	return t.user(cmdMsg.Bot)
+}
+
+// /cointip admin transfer <@user|bank> <@user|bank> <amount> [memo]
+func (p *Plugin) adminTransferCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) < 3 {
+		sayUsage(cmdMsg, adminCommands["transfer"])
+		return
+	}
+	from, err := p.adminParty(cmdMsg, args[0])
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	to, err := p.adminParty(cmdMsg, args[1])
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	amount, err := args[2].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	memo := joinTokens(args[3:])
+	if memo == "" {
+		memo = "cointip admin transfer"
+	}
+
+	record := &tipRecord{From: from, To: to, Amount: amount, Memo: memo}
+	err = p.sendTip(record, false)
+	if err == errSelfTip {
+		say(cmdMsg, "can't transfer to the same tipjar", false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: admin transfer failed")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	log.Infof("cointip: %s transferred %s from %s to %s id: %s", cmdMsg.Command.UserId, amountString(amount), from, to, record.ID)
+	say(cmdMsg, fmt.Sprintf("transferred %s from %s to %s id: %s", amountString(amount), args[0].Text, args[1].Text, record.ID), false)
+}
+
+// /cointip admin refund <tip id>
+func (p *Plugin) adminRefundCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, adminCommands["refund"])
+		return
+	}
+	id := args[0].Text
+
+	tips, err := p.loadTipLog(func(t *tipRecord) bool {
+		return t.ID == id || t.Reverses == id
+	})
+	if err != nil {
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	var original *tipRecord
+	for _, t := range tips {
+		if t.Reverses == id {
+			say(cmdMsg, fmt.Sprintf("tip %s was already sent back with %s", id, t.ID), false)
+			return
+		}
+		original = t
+	}
+	if original == nil {
+		say(cmdMsg, fmt.Sprintf("no tip %s in the tip log", id), false)
+		return
+	}
+
+	err = p.claimRefund(original.ID, cmdMsg.Command.UserId)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	record := &tipRecord{
+		From:     original.To,
+		To:       original.From,
+		Channel:  original.Channel,
+		Amount:   &cointip.Balance{Currency: original.Amount.Currency, Amount: original.Amount.Amount},
+		Memo:     "cointip refund",
+		Reverses: original.ID,
+	}
+	err = p.sendTip(record, false)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed refunding tip %s", id)
+		if mayHaveTransferred(err) {
+			// Left claimed so it isn't sent twice
+			sayError(cmdMsg, fmt.Sprintf("%s - the refund may have gone through, check coinbase", err), false)
+			return
+		}
+		p.releaseRefund(original.ID)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	p.finishRefund(original.ID, record.ID)
+	log.Infof("cointip: %s refunded tip %s with %s", cmdMsg.Command.UserId, id, record.ID)
+	say(cmdMsg, fmt.Sprintf("refunded %s from <@%s> to <@%s> id: %s", amountString(record.Amount), record.From, record.To, record.ID), false)
+}
+
+// claimRefund records that a tip is being refunded, refusing if it already is or was.
+func (p *Plugin) claimRefund(tipId, by string) error {
+	return p.store.Update(refundsBucket, tipId, func(value []byte) ([]byte, error) {
+		if value != nil {
+			claim := &refundClaim{}
+			err := json.Unmarshal(value, claim)
+			if err != nil {
+				return nil, err
+			}
+			if claim.RefundId != "" {
+				return nil, fmt.Errorf("tip %s was already sent back with %s", tipId, claim.RefundId)
+			}
+			return nil, fmt.Errorf("tip %s is already being refunded by <@%s>", tipId, claim.By)
+		}
+		return json.Marshal(&refundClaim{By: by, Time: time.Now().UTC()})
+	})
+}
+
+// finishRefund records the tip that refunded a claimed one.
+func (p *Plugin) finishRefund(tipId, refundId string) {
+	err := p.store.Update(refundsBucket, tipId, func(value []byte) ([]byte, error) {
+		claim := &refundClaim{}
+		if value != nil {
+			err := json.Unmarshal(value, claim)
+			if err != nil {
+				return nil, err
+			}
+		}
+		claim.RefundId = refundId
+		return json.Marshal(claim)
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording refund %s of tip %s", refundId, tipId)
+	}
+}
+
+// releaseRefund drops the claim on a refund that wasn't sent.
+func (p *Plugin) releaseRefund(tipId string) {
+	err := p.store.Delete(refundsBucket, tipId)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed releasing refund of tip %s", tipId)
+	}
+}
+
+// /cointip admin reconcile
+func (p *Plugin) adminReconcileCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	problems := []string{}
+	if p.config.Ledger {
+		problems = p.settleLedger()
+	} else {
+		// Without a ledger there's only the account mapping to check
+		p.store.ForEach(accountsBucket, func(userId string, accountId []byte) error {
+			_, err := p.client.GetAccount(string(accountId))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("account %s for %s: %s", accountId, userId, err))
+			}
+			return nil
+		})
+	}
+
+	if len(problems) == 0 {
+		say(cmdMsg, "everything checks out", false)
+		return
+	}
+	for _, problem := range problems {
+		log.Warnf("cointip: reconciliation: %s", problem)
+	}
+	say(cmdMsg, fmt.Sprintf("%d problems:\n%s", len(problems), strings.Join(problems, "\n")), false)
+}
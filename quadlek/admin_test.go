@@ -0,0 +1,30 @@
+package cointip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClaimRefund(t *testing.T) {
+	p, _ := newTestPlugin(t)
+
+	if err := p.claimRefund("tx-1", "ADMIN1"); err != nil {
+		t.Fatal(err)
+	}
+	err := p.claimRefund("tx-1", "ADMIN2")
+	if err == nil || !strings.Contains(err.Error(), "already being refunded") {
+		t.Fatalf("second claim: got %v", err)
+	}
+
+	// A refund that wasn't sent can be tried again
+	p.releaseRefund("tx-1")
+	if err := p.claimRefund("tx-1", "ADMIN2"); err != nil {
+		t.Fatal(err)
+	}
+
+	p.finishRefund("tx-1", "tx-2")
+	err = p.claimRefund("tx-1", "ADMIN1")
+	if err == nil || !strings.Contains(err.Error(), "already sent back with tx-2") {
+		t.Fatalf("claim after refund: got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package cointip
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+)
+
+type tokenKind int
+
+const (
+	tokenWord    tokenKind = iota
+	tokenQuoted            // "some words"
+	tokenMention           // <@U1234|name>, <@U1234> or @name
+	tokenAmount            // 1.50, $1.50, 1.50USD or 1.50 USD
+)
+
+type token struct {
+	Kind     tokenKind
+	Text     string           // Raw text, without quotes
+	UserId   string           // Set for mentions slack escaped for us
+	UserName string           // Set for plain @name mentions
+	Amount   *cointip.Balance // Set for amounts
+}
+
+// Currencies we can move around, and the symbols that imply them.
+var supportedCurrencies = map[string]bool{
+	cointip.CurrencyUSD: true,
+	cointip.CurrencyBTC: true,
+}
+var currencySymbols = map[string]string{
+	"$": cointip.CurrencyUSD,
+	"₿": cointip.CurrencyBTC,
+	"฿": cointip.CurrencyBTC,
+	"€": "EUR",
+	"£": "GBP",
+	"¥": "JPY",
+}
+
+// Currencies amounts can also be written and displayed in. They're converted to BTC to be moved around.
+var displayCurrencies = map[string]bool{
+	cointip.CurrencyUSD: true,
+	"EUR":               true,
+	"GBP":               true,
+	"CAD":               true,
+	"AUD":               true,
+	"JPY":               true,
+	"CHF":               true,
+}
+
+// Satoshis, 0.00000001 BTC.
+const satoshi = 0.00000001
+
+var satoshiCodes = map[string]bool{
+	"SAT":  true,
+	"SATS": true,
+}
+
+var mentionRegexp = regexp.MustCompile(`^<@([A-Z0-9]+)(?:\|([^>]*))?>$`)
+var amountRegexp = regexp.MustCompile(`^([$₿฿€£¥])?(\d+(?:\.\d*)?|\.\d+)([A-Za-z]{3,4})?$`)
+
+func knownCurrency(code string) bool {
+	return supportedCurrencies[code] || displayCurrencies[code]
+}
+
+// tokenize splits command text on whitespace, keeping quoted strings together and recognizing mentions and amounts.
+// A bare number followed by a currency code ("1.50 USD") becomes a single amount.
+func tokenize(text string) ([]*token, error) {
+	words, err := splitWords(text)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*token{}
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w.quoted {
+			tokens = append(tokens, &token{Kind: tokenQuoted, Text: w.text})
+			continue
+		}
+
+		if m := mentionRegexp.FindStringSubmatch(w.text); m != nil {
+			tokens = append(tokens, &token{Kind: tokenMention, Text: w.text, UserId: m[1], UserName: m[2]})
+			continue
+		}
+		if len(w.text) > 1 && strings.HasPrefix(w.text, "@") {
+			tokens = append(tokens, &token{Kind: tokenMention, Text: w.text, UserName: w.text[1:]})
+			continue
+		}
+
+		if amount := parseAmount(w.text); amount != nil {
+			t := &token{Kind: tokenAmount, Text: w.text, Amount: amount}
+			// Fold a trailing currency code into a bare number
+			if !strings.ContainsAny(w.text, "$₿฿€£¥") && !unicode.IsLetter(rune(w.text[len(w.text)-1])) && i+1 < len(words) {
+				next := strings.ToUpper(words[i+1].text)
+				if !words[i+1].quoted && (knownCurrency(next) || satoshiCodes[next]) {
+					t.Text += " " + words[i+1].text
+					t.Amount.Currency = next
+					if satoshiCodes[next] {
+						t.Amount.Currency = cointip.CurrencyBTC
+						t.Amount.Amount *= satoshi
+					}
+					i++
+				}
+			}
+			tokens = append(tokens, t)
+			continue
+		}
+
+		tokens = append(tokens, &token{Kind: tokenWord, Text: w.text})
+	}
+
+	return tokens, nil
+}
+
+type word struct {
+	text   string
+	quoted bool
+}
+
+// splitWords splits on whitespace, honoring straight and curly double quotes.
+func splitWords(text string) ([]word, error) {
+	words := []word{}
+	current := []rune{}
+	inWord := false
+	var closeQuote rune
+
+	flush := func(quoted bool) {
+		if inWord || quoted {
+			words = append(words, word{text: string(current), quoted: quoted})
+		}
+		current = current[:0]
+		inWord = false
+	}
+
+	for _, r := range text {
+		switch {
+		case closeQuote != 0:
+			if r == closeQuote {
+				closeQuote = 0
+				flush(true)
+				continue
+			}
+			current = append(current, r)
+		case (r == '"' || r == '“') && !inWord:
+			closeQuote = '"'
+			if r == '“' {
+				closeQuote = '”'
+			}
+		case unicode.IsSpace(r):
+			flush(false)
+		default:
+			current = append(current, r)
+			inWord = true
+		}
+	}
+	if closeQuote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	flush(false)
+
+	return words, nil
+}
+
+// parseAmount parses amounts like $1.50, 1.50, 1.50USD, €2, 0.001BTC or 1000sat, returning nil if s isn't an amount.
+// Amounts without a currency are USD.
+func parseAmount(s string) *cointip.Balance {
+	m := amountRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil
+	}
+
+	currency := cointip.CurrencyUSD
+	if m[1] != "" {
+		currency = currencySymbols[m[1]]
+	}
+	value, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return nil
+	}
+
+	if m[3] != "" {
+		code := strings.ToUpper(m[3])
+		if satoshiCodes[code] && m[1] == "" {
+			return &cointip.Balance{Currency: cointip.CurrencyBTC, Amount: value * satoshi}
+		}
+		if !knownCurrency(code) || (m[1] != "" && code != currency) {
+			return nil
+		}
+		currency = code
+	}
+
+	return &cointip.Balance{Currency: currency, Amount: value}
+}
+
+// user resolves a mention token to a slack user id.
+func (t *token) user(bot *quadlek.Bot) (string, error) {
+	if t.Kind != tokenMention {
+		return "", fmt.Errorf("expected a @user mention, got %q", t.Text)
+	}
+	if t.UserId != "" {
+		return t.UserId, nil
+	}
+	userId, err := bot.GetUserId(t.UserName)
+	if err != nil {
+		return "", fmt.Errorf("unknown user @%s", t.UserName)
+	}
+	return userId, nil
+}
+
+// amount returns a positive amount from an amount token.
+func (t *token) amount() (*cointip.Balance, error) {
+	if t.Kind != tokenAmount {
+		return nil, fmt.Errorf("expected an amount like $1.50, €2, 0.0001 BTC or 1000sat, got %q", t.Text)
+	}
+	if t.Amount.Amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive, got %q", t.Text)
+	}
+	return &cointip.Balance{Currency: t.Amount.Currency, Amount: t.Amount.Amount}, nil
+}
+
+// joinTokens joins the raw text of tokens back together, e.g. for free-form memos.
+func joinTokens(tokens []*token) string {
+	texts := []string{}
+	for _, t := range tokens {
+		texts = append(texts, t.Text)
+	}
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,144 @@
+package cointip
+
+import (
+	"math"
+	"testing"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text   string
+		kinds  []tokenKind
+		texts  []string
+		hasErr bool
+	}{
+		{text: "", kinds: []tokenKind{}, texts: []string{}},
+		{text: "  balance  ", kinds: []tokenKind{tokenWord}, texts: []string{"balance"}},
+		{
+			text:  `tip <@U123|bob> 1.50 USD "thanks for the review"`,
+			kinds: []tokenKind{tokenWord, tokenMention, tokenAmount, tokenQuoted},
+			texts: []string{"tip", "<@U123|bob>", "1.50 USD", "thanks for the review"},
+		},
+		{
+			text:  `bounty $20 “fix flaky CI”`,
+			kinds: []tokenKind{tokenWord, tokenAmount, tokenQuoted},
+			texts: []string{"bounty", "$20", "fix flaky CI"},
+		},
+		{text: `say ""`, kinds: []tokenKind{tokenWord, tokenQuoted}, texts: []string{"say", ""}},
+		{text: `it's "fine`, hasErr: true},
+		// Quotes inside a word don't start a quoted string
+		{text: `don"t`, kinds: []tokenKind{tokenWord}, texts: []string{`don"t`}},
+		{text: "@alice 5", kinds: []tokenKind{tokenMention, tokenAmount}, texts: []string{"@alice", "5"}},
+		{text: "@", kinds: []tokenKind{tokenWord}, texts: []string{"@"}},
+		{text: "1000 sat", kinds: []tokenKind{tokenAmount}, texts: []string{"1000 sat"}},
+		// Only known currency codes are folded into the amount
+		{text: "5 apples", kinds: []tokenKind{tokenAmount, tokenWord}, texts: []string{"5", "apples"}},
+		{text: `5 "USD"`, kinds: []tokenKind{tokenAmount, tokenQuoted}, texts: []string{"5", "USD"}},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.text)
+		if test.hasErr {
+			if err == nil {
+				t.Errorf("tokenize(%q): expected an error", test.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tokenize(%q): %s", test.text, err)
+			continue
+		}
+		if len(tokens) != len(test.kinds) {
+			t.Errorf("tokenize(%q): got %d tokens, want %d", test.text, len(tokens), len(test.kinds))
+			continue
+		}
+		for i, tok := range tokens {
+			if tok.Kind != test.kinds[i] || tok.Text != test.texts[i] {
+				t.Errorf("tokenize(%q)[%d]: got %d %q, want %d %q", test.text, i, tok.Kind, tok.Text, test.kinds[i], test.texts[i])
+			}
+		}
+	}
+}
+
+func TestTokenizeMentions(t *testing.T) {
+	tests := []struct {
+		text     string
+		userId   string
+		userName string
+	}{
+		{text: "<@U123|bob>", userId: "U123", userName: "bob"},
+		{text: "<@U123>", userId: "U123"},
+		{text: "@bob", userName: "bob"},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.text)
+		if err != nil || len(tokens) != 1 {
+			t.Errorf("tokenize(%q): got %v, %v", test.text, tokens, err)
+			continue
+		}
+		if tokens[0].Kind != tokenMention || tokens[0].UserId != test.userId || tokens[0].UserName != test.userName {
+			t.Errorf("tokenize(%q): got %+v", test.text, tokens[0])
+		}
+	}
+}
+
+func TestTokenizeAmounts(t *testing.T) {
+	tests := []struct {
+		text     string
+		currency string
+		amount   float64
+	}{
+		{text: "1.50", currency: cointip.CurrencyUSD, amount: 1.50},
+		{text: ".5", currency: cointip.CurrencyUSD, amount: 0.5},
+		{text: "$1.50", currency: cointip.CurrencyUSD, amount: 1.50},
+		{text: "1.50USD", currency: cointip.CurrencyUSD, amount: 1.50},
+		{text: "1.50 usd", currency: cointip.CurrencyUSD, amount: 1.50},
+		{text: "€2", currency: "EUR", amount: 2},
+		{text: "2 GBP", currency: "GBP", amount: 2},
+		{text: "₿0.001", currency: cointip.CurrencyBTC, amount: 0.001},
+		{text: "0.001BTC", currency: cointip.CurrencyBTC, amount: 0.001},
+		{text: "1000sat", currency: cointip.CurrencyBTC, amount: 0.00001},
+		{text: "1000 SATS", currency: cointip.CurrencyBTC, amount: 0.00001},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.text)
+		if err != nil || len(tokens) != 1 || tokens[0].Kind != tokenAmount {
+			t.Errorf("tokenize(%q): expected one amount, got %v, %v", test.text, tokens, err)
+			continue
+		}
+		amount := tokens[0].Amount
+		if amount.Currency != test.currency || math.Abs(amount.Amount-test.amount) > 1e-12 {
+			t.Errorf("tokenize(%q): got %s %f, want %s %f", test.text, amount.Currency, amount.Amount, test.currency, test.amount)
+		}
+	}
+}
+
+func TestParseAmountRejects(t *testing.T) {
+	for _, text := range []string{"abc", "$", "1.2.3", "$5EUR", "5XYZ", "€5sat", "-5", "1,000"} {
+		if amount := parseAmount(text); amount != nil {
+			t.Errorf("parseAmount(%q): got %+v, want nil", text, amount)
+		}
+	}
+}
+
+func TestTokenAmountMustBePositive(t *testing.T) {
+	tokens, err := tokenize("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens[0].amount(); err == nil {
+		t.Errorf("amount() of 0: expected an error")
+	}
+
+	tokens, err = tokenize("lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens[0].amount(); err == nil {
+		t.Errorf("amount() of a word: expected an error")
+	}
+}
@@ -0,0 +1,18 @@
+package cointip
+
+import (
+	"context"
+)
+
+// Background jobs are registered while setting up the plugin and started once with the plugin's context.
+func (p *Plugin) registerBackground(job func(ctx context.Context)) {
+	p.backgroundJobs = append(p.backgroundJobs, job)
+}
+
+func (p *Plugin) startBackground(ctx context.Context) {
+	p.backgroundOnce.Do(func() {
+		for _, job := range p.backgroundJobs {
+			go job(ctx)
+		}
+	})
+}
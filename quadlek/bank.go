@@ -0,0 +1,199 @@
+package cointip
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// BankMonitor watches the bank balance, alerting an ops channel when it runs low and optionally topping it up.
+type BankMonitor struct {
+	Every     time.Duration   // How often to check the balance. Defaults to 10 minutes
+	Threshold cointip.Balance // Alert when the bank holds less than this
+	Channel   string          // Ops channel for alerts. Alerts are only logged without one
+
+	TopUp              *cointip.Balance // How much to add when the bank is low, nil to only alert
+	TopUpPaymentMethod string           // Buy the top up with this payment method...
+	TopUpAccount       string           // ...or transfer it from this coinbase account id
+}
+
+const (
+	defaultBankCheckEvery = 10 * time.Minute
+
+	// Don't repeat an alert or top up while the bank stays low, buys take a while to land.
+	bankAlertEvery   = 24 * time.Hour
+	bankTopUpEvery   = 24 * time.Hour
+	bankLowAlertKey  = "bank_low_alerted"
+	bankLastTopUpKey = "bank_topped_up"
+)
+
+func (m *BankMonitor) validate() error {
+	if !supportedCurrencies[m.Threshold.Currency] || m.Threshold.Amount <= 0 {
+		return fmt.Errorf("invalid bank threshold %s:%f", m.Threshold.Currency, m.Threshold.Amount)
+	}
+	if m.TopUp == nil {
+		return nil
+	}
+	if !supportedCurrencies[m.TopUp.Currency] || m.TopUp.Amount <= 0 {
+		return fmt.Errorf("invalid bank top up %s:%f", m.TopUp.Currency, m.TopUp.Amount)
+	}
+	if (m.TopUpPaymentMethod == "") == (m.TopUpAccount == "") {
+		return fmt.Errorf("bank top up needs exactly one of a payment method or an account")
+	}
+	return nil
+}
+
+// opsAlert logs a problem and posts it to the ops channel, if there is one.
+func (p *Plugin) opsAlert(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warnf("cointip: %s", msg)
+
+	m := p.config.BankMonitor
+	if m == nil || m.Channel == "" {
+		return
+	}
+	bot := p.getBot()
+	if bot == nil {
+		log.Infof("cointip: can't post alert to %s - no bot yet", m.Channel)
+		return
+	}
+	bot.Say(m.Channel, fmt.Sprintf(":rotating_light: cointip: %s", msg))
+}
+
+// bankHolds returns what the bank holds in the given currency, converting its native balance at the current exchange
+// rate if the account is in neither.
+func (p *Plugin) bankHolds(account *cointip.Account, currency string) (float64, error) {
+	switch currency {
+	case account.Balance.Currency:
+		return account.Balance.Amount, nil
+	case account.NativeBalance.Currency:
+		return account.NativeBalance.Amount, nil
+	}
+	holds, err := p.convert(&account.NativeBalance, currency)
+	if err != nil {
+		return 0, err
+	}
+	return holds.Amount, nil
+}
+
+// due returns true, and records now, if key was last recorded more than every ago.
+func (p *Plugin) due(key string, every time.Duration) bool {
+	due := false
+	err := p.store.Update(metaBucket, key, func(value []byte) ([]byte, error) {
+		if value != nil {
+			last, err := time.Parse(time.RFC3339, string(value))
+			if err == nil && time.Since(last) < every {
+				return value, nil
+			}
+		}
+		due = true
+		return []byte(time.Now().UTC().Format(time.RFC3339)), nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed checking %s", key)
+		return false
+	}
+	return due
+}
+
+// elapsed returns true if key was last recorded more than every ago, without recording anything.
+func (p *Plugin) elapsed(key string, every time.Duration) bool {
+	value, err := p.store.Get(metaBucket, key)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed checking %s", key)
+		return false
+	}
+	if value == nil {
+		return true
+	}
+	last, err := time.Parse(time.RFC3339, string(value))
+	return err != nil || time.Since(last) >= every
+}
+
+// recordNow records now for key, for due and elapsed.
+func (p *Plugin) recordNow(key string) {
+	err := p.store.Put(metaBucket, key, []byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording %s", key)
+	}
+}
+
+func (p *Plugin) checkBank() {
+	m := p.config.BankMonitor
+
+	account, err := p.client.GetAccount(p.bankAccount.ID)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed checking bank balance")
+		return
+	}
+
+	holds, err := p.bankHolds(account, m.Threshold.Currency)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed checking bank balance")
+		return
+	}
+	if holds >= m.Threshold.Amount {
+		// Alert straight away the next time it runs low
+		p.store.Delete(metaBucket, bankLowAlertKey)
+		return
+	}
+
+	if p.due(bankLowAlertKey, bankAlertEvery) {
+		p.opsAlert("bank %s (%s) is low: %s, threshold %s", account.Name, account.ID, accountBalanceString(account), amountString(&m.Threshold))
+	}
+
+	// Only a top up that happened, or may have, waits a day. One coinbase refused is tried again next check.
+	if m.TopUp != nil && p.elapsed(bankLastTopUpKey, bankTopUpEvery) {
+		err := p.topUpBank()
+		if err == nil || mayHaveTransferred(err) {
+			p.recordNow(bankLastTopUpKey)
+		}
+	}
+}
+
+// topUpBank adds m.TopUp to the bank from the configured payment method or account. Coinbase errors are returned as
+// transferErrors.
+func (p *Plugin) topUpBank() error {
+	m := p.config.BankMonitor
+	amount := &cointip.Balance{Currency: m.TopUp.Currency, Amount: m.TopUp.Amount}
+
+	if m.TopUpAccount != "" {
+		tx, err := p.client.TransferWithDescription(m.TopUpAccount, p.bankAccount.ID, amount, "cointip bank top up")
+		if err != nil {
+			p.opsAlert("failed topping up bank with %s from account %s: %s", amountString(amount), m.TopUpAccount, err)
+			return &transferError{err}
+		}
+		p.opsAlert("topped up bank with %s from account %s txid: %s", amountString(amount), m.TopUpAccount, tx.ID)
+		return nil
+	}
+
+	buy, err := p.client.CreateBuy(p.bankAccount.ID, m.TopUpPaymentMethod, amount, true)
+	if err != nil {
+		p.opsAlert("failed topping up bank with %s from payment method %s: %s", amountString(amount), m.TopUpPaymentMethod, err)
+		return &transferError{err}
+	}
+	p.opsAlert("topped up bank with %s (total %s, status %s) buy: %s", amountString(&buy.Amount), amountString(&buy.Total), buy.Status, buy.ID)
+	return nil
+}
+
+func (p *Plugin) bankMonitorLoop(ctx context.Context) {
+	every := p.config.BankMonitor.Every
+	if every <= 0 {
+		every = defaultBankCheckEvery
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkBank()
+		case <-ctx.Done():
+			log.Info("cointip: stopping bank monitor")
+			return
+		}
+	}
+}
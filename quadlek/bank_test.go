@@ -0,0 +1,56 @@
+package cointip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestBankHolds(t *testing.T) {
+	p, _ := newTestPlugin(t)
+	account := &cointip.Account{
+		Balance:       cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.01},
+		NativeBalance: cointip.Balance{Currency: "EUR", Amount: 80},
+	}
+
+	tests := []struct {
+		currency string
+		holds    float64
+	}{
+		{cointip.CurrencyBTC, 0.01},
+		{"EUR", 80},
+		// Neither of the account's currencies, so the native balance is converted
+		{cointip.CurrencyUSD, 100},
+	}
+	for _, test := range tests {
+		holds, err := p.bankHolds(account, test.currency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if holds != test.holds {
+			t.Errorf("%s: got %f, want %f", test.currency, holds, test.holds)
+		}
+	}
+}
+
+func TestRefusedTopUpIsRetried(t *testing.T) {
+	p, fc := newTestPlugin(t)
+	topUp := fc.addAccount("topup", 1000)
+	p.config.BankMonitor = &BankMonitor{Threshold: *usd(200), TopUp: usd(50), TopUpAccount: topUp.ID}
+
+	fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+		return &cointip.Error{StatusCode: http.StatusBadRequest, Errors: []cointip.APIError{{ID: "invalid_request"}}}
+	}
+	p.checkBank()
+	if !p.elapsed(bankLastTopUpKey, bankTopUpEvery) {
+		t.Fatal("a refused top up was recorded")
+	}
+
+	fc.transferErr = nil
+	p.checkBank()
+	p.checkBank()
+	if usd := fc.usd(p.bankAccount.ID); usd != 150 {
+		t.Fatalf("bank has $%.2f, want one $50.00 top up", usd)
+	}
+}
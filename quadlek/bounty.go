@@ -0,0 +1,688 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bounty funds are held in an escrow tipjar until the bounty is awarded, cancelled or expires. Escrow moves are always
+// coinbase transfers, even in ledger mode, so the escrow account really holds what open bounties are worth.
+const (
+	bountiesBucket = "bounties"
+	bountySeqKey   = "bounty_seq"
+
+	// Internal user ids start with an underscore, slack ids never do.
+	escrowUserId = "_escrow"
+
+	bountyCheckEvery = 10 * time.Minute
+
+	// A bounty that's been funding or paying this long was interrupted, and is checked against the escrow account's
+	// transactions
+	bountyStaleAfter = 10 * time.Minute
+	bountyRecoverTxs = 100
+)
+
+const (
+	bountyFunding   = "funding" // Saved before the funds move into escrow
+	bountyFailed    = "failed"  // Never funded
+	bountyOpen      = "open"
+	bountyPaying    = "paying" // Claimed by an award, cancel or expiry that's moving the funds
+	bountyAwarded   = "awarded"
+	bountyCancelled = "cancelled"
+	bountyExpired   = "expired"
+)
+
+type bounty struct {
+	ID        string           `json:"id"`
+	Creator   string           `json:"creator"`
+	Title     string           `json:"title"`
+	Amount    *cointip.Balance `json:"amount"`
+	Channel   string           `json:"channel"`
+	Status    string           `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+	ExpiresAt time.Time        `json:"expires_at"` // Zero for never
+	EscrowTx  string           `json:"escrow_tx"`
+	Spend     string           `json:"spend"`   // Limits spend id reserved for it, given back if it's never funded
+	PaidTo    string           `json:"paid_to"` // Winner, or the creator for refunds
+	Payout    string           `json:"payout"`  // Status the bounty ends in once paid out
+	ClaimedAt time.Time        `json:"claimed_at"`
+	PayoutTx  string           `json:"payout_tx"`
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "bounty",
+		Usage: "<amount> \"title\" | list | award <id> @user | cancel <id>",
+		Help:  "Put money up for a task, and award it when it's done",
+		Run:   (*Plugin).bountyCommand,
+	})
+}
+
+func internalUser(userId string) bool {
+	return strings.HasPrefix(userId, "_")
+}
+
+func (p *Plugin) saveBounty(b *bounty) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(bountiesBucket, b.ID, data)
+}
+
+// claimBounty moves an open bounty to paying so only one award, cancel or expiry pays it out, recording who it's
+// paying, the winner or "" for the creator, and the status it ends in.
+func (p *Plugin) claimBounty(id, to, status string, fn func(b *bounty) error) (*bounty, error) {
+	var claimed *bounty
+	err := p.store.Update(bountiesBucket, id, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, fmt.Errorf("no bounty #%s", id)
+		}
+		b := &bounty{}
+		err := json.Unmarshal(value, b)
+		if err != nil {
+			return nil, err
+		}
+		if b.Status != bountyOpen {
+			return nil, fmt.Errorf("bounty #%s is %s", id, b.Status)
+		}
+		err = fn(b)
+		if err != nil {
+			return nil, err
+		}
+		b.Status = bountyPaying
+		b.PaidTo = to
+		if to == "" {
+			b.PaidTo = b.Creator
+		}
+		b.Payout = status
+		b.ClaimedAt = time.Now().UTC()
+		claimed = b
+		return json.Marshal(b)
+	})
+	return claimed, err
+}
+
+// escrowTransfer moves funds in or out of escrow with a coinbase transfer, and logs it like a tip.
+func (p *Plugin) escrowTransfer(from, to string, amount *cointip.Balance, memo string) (*tipRecord, error) {
+	if p.config.Ledger && !internalUser(from) {
+		err := p.settleUserAll(from)
+		if err != nil {
+			return nil, fmt.Errorf("failed settling ledger: %w", err)
+		}
+	}
+
+	fromAccount, err := p.getOrCreateAccount(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+	toAccount, err := p.getOrCreateAccount(to)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+
+	tx, err := p.client.TransferWithDescription(fromAccount.ID, toAccount.ID, amount, memo)
+	if err != nil {
+		return nil, &transferError{err}
+	}
+
+	t := &tipRecord{ID: tx.ID, From: from, To: to, Amount: amount, Memo: memo, Time: time.Now().UTC()}
+	p.logTip(t)
+	log.Infof("cointip: escrow transfer %s from:%s to:%s txid: %s", amountString(amount), from, to, tx.ID)
+	return t, nil
+}
+
+// reopenBounty puts a bounty whose payout didn't happen back up.
+func reopenBounty(b *bounty) {
+	b.Status = bountyOpen
+	b.PaidTo = ""
+	b.Payout = ""
+	b.ClaimedAt = time.Time{}
+}
+
+func bountyEscrowMemo(b *bounty) string {
+	return fmt.Sprintf("cointip bounty #%s: %s", b.ID, b.Title)
+}
+
+func bountyPayoutMemo(b *bounty) string {
+	return fmt.Sprintf("cointip bounty #%s %s: %s", b.ID, b.Payout, b.Title)
+}
+
+// payOutBounty pays a claimed bounty and records the outcome. If coinbase refused the transfer the bounty is reopened;
+// if the transfer may have gone through it's left paying for recoverBounties to sort out.
+func (p *Plugin) payOutBounty(b *bounty) error {
+	t, err := p.escrowTransfer(escrowUserId, b.PaidTo, b.Amount, bountyPayoutMemo(b))
+	if err != nil {
+		if mayHaveTransferred(err) {
+			log.WithError(err).Errorf("cointip: bounty #%s payout may have failed, leaving it for recovery", b.ID)
+			return fmt.Errorf("%s - the payout will be checked against coinbase and finished or reopened within %s", err, bountyStaleAfter+bountyCheckEvery)
+		}
+		reopenBounty(b)
+	} else {
+		b.Status = b.Payout
+		b.PayoutTx = t.ID
+	}
+	if saveErr := p.saveBounty(b); saveErr != nil {
+		log.WithError(saveErr).Errorf("cointip: failed saving bounty #%s as %s", b.ID, b.Status)
+	}
+	return err
+}
+
+func (p *Plugin) bountyString(b *bounty) string {
+	s := fmt.Sprintf("#%s %s by <@%s>: %s", b.ID, amountString(b.Amount), b.Creator, b.Title)
+	if !b.ExpiresAt.IsZero() {
+		s += fmt.Sprintf(" (expires %s)", b.ExpiresAt.Format("Jan 2 15:04"))
+	}
+	return s
+}
+
+// /cointip bounty <amount> "title"
+// /cointip bounty list
+// /cointip bounty award <id> @user
+// /cointip bounty cancel <id>
+func (p *Plugin) bountyCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) == 0 {
+		sayUsage(cmdMsg, subcommands["bounty"])
+		return
+	}
+
+	switch strings.ToLower(args[0].Text) {
+	case "list":
+		p.listBounties(cmdMsg)
+	case "award":
+		p.awardBounty(cmdMsg, args[1:])
+	case "cancel":
+		p.cancelBounty(cmdMsg, args[1:])
+	default:
+		p.createBounty(cmdMsg, args)
+	}
+}
+
+func (p *Plugin) createBounty(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) < 2 {
+		sayUsage(cmdMsg, subcommands["bounty"])
+		return
+	}
+	creator := cmdMsg.Command.UserId
+
+	amount, err := args[0].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	amount, err = p.transferAmount(amount)
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty failed")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	title := joinTokens(args[1:])
+
+	// Putting up a bounty is spending, so it's held to the same rules as a tip
+	err = p.checkFrozen(creator)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	account, err := p.getOrCreateAccount(creator)
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty failed - failed fetching coinbase account")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	whole := &tipRecord{From: creator, Channel: cmdMsg.Command.ChannelId, Amount: amount, Time: time.Now().UTC()}
+	reserved, err := p.reserveTipSpend(whole, account)
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty failed - failed checking limits")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	id, err := p.nextId(bountySeqKey)
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty failed - failed allocating id")
+		p.releaseSpend(creator, reserved)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	b := &bounty{
+		ID:        id,
+		Creator:   creator,
+		Title:     title,
+		Amount:    amount,
+		Channel:   cmdMsg.Command.ChannelId,
+		Status:    bountyFunding,
+		CreatedAt: time.Now().UTC(),
+	}
+	if p.config.BountyExpiry > 0 {
+		b.ExpiresAt = b.CreatedAt.Add(p.config.BountyExpiry)
+	}
+	if reserved != nil {
+		b.Spend = reserved.ID
+	}
+
+	// Saved before the funds move so recoverBounties finds the bounty if we crash part way through
+	err = p.saveBounty(b)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: bounty failed - failed saving bounty #%s", b.ID)
+		p.releaseSpend(creator, reserved)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	t, err := p.escrowTransfer(creator, escrowUserId, amount, bountyEscrowMemo(b))
+	if err != nil {
+		if mayHaveTransferred(err) {
+			log.WithError(err).Errorf("cointip: bounty #%s escrow transfer may have failed, leaving it for recovery", b.ID)
+			sayError(cmdMsg, fmt.Sprintf("%s - the bounty will be checked against coinbase and opened or dropped within %s", err, bountyStaleAfter+bountyCheckEvery), false)
+			return
+		}
+		log.WithError(err).Error("cointip: bounty failed - failed moving funds to escrow")
+		b.Status = bountyFailed
+		if saveErr := p.saveBounty(b); saveErr != nil {
+			log.WithError(saveErr).Errorf("cointip: failed saving bounty #%s as %s", b.ID, b.Status)
+		}
+		p.releaseSpend(creator, reserved)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	_, err = p.updateBounty(b.ID, bountyFunding, func(b *bounty) {
+		b.Status = bountyOpen
+		b.EscrowTx = t.ID
+	})
+	if err != nil {
+		// Still funding, recoverBounties opens it once it finds the escrow transfer
+		log.WithError(err).Errorf("cointip: failed opening bounty #%s, escrow tx %s", b.ID, t.ID)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: %s opened bounty #%s %s escrow tx %s", creator, b.ID, amountString(amount), t.ID)
+	say(cmdMsg, fmt.Sprintf("<@%s> put up a bounty: %s\n`/cointip bounty award %s @user` when it's done", creator, p.bountyString(b), b.ID), true)
+}
+
+func (p *Plugin) listBounties(cmdMsg *quadlek.CommandMsg) {
+	open := []*bounty{}
+	err := p.store.ForEach(bountiesBucket, func(key string, value []byte) error {
+		b := &bounty{}
+		err := json.Unmarshal(value, b)
+		if err != nil {
+			return err
+		}
+		if b.Status == bountyOpen {
+			open = append(open, b)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed listing bounties")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(open) == 0 {
+		say(cmdMsg, "no open bounties", false)
+		return
+	}
+
+	sort.Slice(open, func(i, j int) bool {
+		a, _ := strconv.Atoi(open[i].ID)
+		b, _ := strconv.Atoi(open[j].ID)
+		return a < b
+	})
+	lines := []string{}
+	for _, b := range open {
+		lines = append(lines, p.bountyString(b))
+	}
+	say(cmdMsg, "open bounties:\n"+strings.Join(lines, "\n"), false)
+}
+
+// canManage returns an error unless the user created the bounty or is an admin.
+func (p *Plugin) canManage(userId string) func(b *bounty) error {
+	return func(b *bounty) error {
+		if b.Creator != userId && !p.isAdmin(userId) {
+			return fmt.Errorf("only <@%s> can do that with bounty #%s", b.Creator, b.ID)
+		}
+		return nil
+	}
+}
+
+// getBounty returns a bounty, or nil if there's no such bounty.
+func (p *Plugin) getBounty(id string) (*bounty, error) {
+	data, err := p.store.Get(bountiesBucket, id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	b := &bounty{}
+	err = json.Unmarshal(data, b)
+	return b, err
+}
+
+// reserveAwardSpend holds an award to the creator's limits for tipping the winner, and records it against the per
+// recipient cap. The creator's totals already include the bounty from when it was put up. Returns nil if there are no
+// limits.
+func (p *Plugin) reserveAwardSpend(b *bounty, winner string) (*spend, error) {
+	if p.config.Limits == nil {
+		return nil, nil
+	}
+	account, err := p.getOrCreateAccount(b.Creator)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+	amount, err := p.convertForLimits(b.Amount, account)
+	if err != nil {
+		return nil, err
+	}
+	return p.reserveRecipientSpend(b.Creator, winner, amount)
+}
+
+// checkAward refuses awards the creator couldn't make as a tip: to themselves, or from a frozen tipjar.
+func (p *Plugin) checkAward(b *bounty, winner string) error {
+	if winner == b.Creator {
+		return refuse("bounty #%s can't be awarded to <@%s>, cancel it instead", b.ID, b.Creator)
+	}
+	err := p.checkFrozen(b.Creator)
+	if isLimitError(err) {
+		return refuse("<@%s>'s tipjar is frozen, ask an admin", b.Creator)
+	}
+	return err
+}
+
+// /cointip bounty award <id> @user
+func (p *Plugin) awardBounty(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 2 {
+		sayUsage(cmdMsg, subcommands["bounty"])
+		return
+	}
+	id := strings.TrimPrefix(args[0].Text, "#")
+	winner, err := args[1].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	b, err := p.getBounty(id)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed loading bounty #%s", id)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if b == nil {
+		say(cmdMsg, fmt.Sprintf("no bounty #%s", id), false)
+		return
+	}
+	err = p.checkAward(b, winner)
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty award failed - failed checking creator")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	reserved, err := p.reserveAwardSpend(b, winner)
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: bounty award failed - failed checking limits")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	claimed, err := p.claimBounty(id, winner, bountyAwarded, p.canManage(cmdMsg.Command.UserId))
+	if err != nil {
+		p.releaseSpend(b.Creator, reserved)
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	b = claimed
+
+	err = p.payOutBounty(b)
+	if err != nil {
+		// A refused payout reopens the bounty, one that may have gone through is left for recovery
+		if b.Status == bountyOpen {
+			p.releaseSpend(b.Creator, reserved)
+		}
+		log.WithError(err).Errorf("cointip: failed awarding bounty #%s", b.ID)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: bounty #%s awarded to %s tx %s", b.ID, winner, b.PayoutTx)
+	p.dm(winner, fmt.Sprintf("You won bounty #%s from <@%s>: %s %s", b.ID, b.Creator, b.Title, p.displayAmount(winner, b.Amount)))
+	say(cmdMsg, fmt.Sprintf("<@%s> awarded bounty #%s (%s) to <@%s>: %s", cmdMsg.Command.UserId, b.ID, amountString(b.Amount), winner, b.Title), true)
+}
+
+// /cointip bounty cancel <id>
+func (p *Plugin) cancelBounty(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, subcommands["bounty"])
+		return
+	}
+
+	b, err := p.claimBounty(strings.TrimPrefix(args[0].Text, "#"), "", bountyCancelled, p.canManage(cmdMsg.Command.UserId))
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	err = p.payOutBounty(b)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed refunding bounty #%s", b.ID)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: bounty #%s cancelled tx %s", b.ID, b.PayoutTx)
+	say(cmdMsg, fmt.Sprintf("cancelled bounty #%s, %s went back to <@%s>", b.ID, amountString(b.Amount), b.Creator), false)
+}
+
+// expireBounties refunds open bounties past their expiry to their creators.
+func (p *Plugin) expireBounties() {
+	expired := []string{}
+	p.store.ForEach(bountiesBucket, func(key string, value []byte) error {
+		b := &bounty{}
+		if json.Unmarshal(value, b) == nil && b.Status == bountyOpen && !b.ExpiresAt.IsZero() && time.Now().After(b.ExpiresAt) {
+			expired = append(expired, b.ID)
+		}
+		return nil
+	})
+
+	for _, id := range expired {
+		b, err := p.claimBounty(id, "", bountyExpired, func(b *bounty) error { return nil })
+		if err != nil {
+			continue
+		}
+		err = p.payOutBounty(b)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed refunding expired bounty #%s, will retry", b.ID)
+			continue
+		}
+		log.Infof("cointip: bounty #%s expired tx %s", b.ID, b.PayoutTx)
+		p.dm(b.Creator, fmt.Sprintf("Your bounty #%s expired and %s went back to your tipjar: %s", b.ID, p.displayAmount(b.Creator, b.Amount), b.Title))
+	}
+}
+
+// recoverBounties finishes or reopens payouts that were interrupted, and opens or drops bounties whose funding was,
+// by looking for the transfer in the escrow account's recent transactions.
+func (p *Plugin) recoverBounties() {
+	stale := []*bounty{}
+	p.store.ForEach(bountiesBucket, func(key string, value []byte) error {
+		b := &bounty{}
+		if json.Unmarshal(value, b) != nil {
+			return nil
+		}
+		if b.Status == bountyPaying && time.Since(b.ClaimedAt) > bountyStaleAfter ||
+			b.Status == bountyFunding && time.Since(b.CreatedAt) > bountyStaleAfter {
+			stale = append(stale, b)
+		}
+		return nil
+	})
+	if len(stale) == 0 {
+		return
+	}
+
+	escrow, err := p.getOrCreateAccount(escrowUserId)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed recovering bounties - failed fetching escrow account")
+		return
+	}
+	txs, err := p.client.ListTransactions(escrow.ID, bountyRecoverTxs)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed recovering bounties - failed listing escrow transactions")
+		return
+	}
+
+	for _, b := range stale {
+		if b.Status == bountyFunding {
+			p.recoverFunding(b, txs)
+			continue
+		}
+
+		memo := bountyPayoutMemo(b)
+		var paid *cointip.Transaction
+		for _, tx := range txs {
+			if tx.Description == memo && tx.Amount.Amount < 0 {
+				paid = tx
+				break
+			}
+		}
+
+		if paid == nil && len(txs) >= bountyRecoverTxs && !listedSince(txs, b.ClaimedAt) {
+			// The payout could be older than anything listed, so we can't tell
+			if p.due("bounty_stuck_alert_"+b.ID, day) {
+				p.opsAlert("bounty #%s has been paying %s to <@%s> since %s and needs checking by hand", b.ID, amountString(b.Amount), b.PaidTo, b.ClaimedAt.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		_, err := p.updateBounty(b.ID, bountyPaying, func(b *bounty) {
+			if paid == nil {
+				reopenBounty(b)
+				return
+			}
+			b.Status = b.Payout
+			b.PayoutTx = paid.ID
+		})
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed recovering bounty #%s", b.ID)
+			continue
+		}
+
+		if paid == nil {
+			log.Infof("cointip: reopened bounty #%s, its %s payout never happened", b.ID, b.Payout)
+			continue
+		}
+		p.logTip(&tipRecord{ID: paid.ID, From: escrowUserId, To: b.PaidTo, Amount: b.Amount, Memo: memo, Time: time.Now().UTC()})
+		log.Infof("cointip: recovered bounty #%s %s to %s tx %s", b.ID, b.Payout, b.PaidTo, paid.ID)
+	}
+}
+
+// recoverFunding opens a bounty whose escrow transfer went through, and drops one whose transfer never happened.
+func (p *Plugin) recoverFunding(b *bounty, txs []*cointip.Transaction) {
+	memo := bountyEscrowMemo(b)
+	var funded *cointip.Transaction
+	for _, tx := range txs {
+		if tx.Description == memo && tx.Amount.Amount > 0 {
+			funded = tx
+			break
+		}
+	}
+
+	if funded == nil && len(txs) >= bountyRecoverTxs && !listedSince(txs, b.CreatedAt) {
+		if p.due("bounty_stuck_alert_"+b.ID, day) {
+			p.opsAlert("bounty #%s has been funding %s from <@%s> since %s and needs checking by hand", b.ID, amountString(b.Amount), b.Creator, b.CreatedAt.Format(time.RFC3339))
+		}
+		return
+	}
+
+	_, err := p.updateBounty(b.ID, bountyFunding, func(b *bounty) {
+		if funded == nil {
+			b.Status = bountyFailed
+			return
+		}
+		b.Status = bountyOpen
+		b.EscrowTx = funded.ID
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recovering bounty #%s", b.ID)
+		return
+	}
+
+	if funded == nil {
+		if b.Spend != "" {
+			p.releaseSpend(b.Creator, &spend{ID: b.Spend})
+		}
+		log.Infof("cointip: dropped bounty #%s, its escrow transfer never happened", b.ID)
+		p.dm(b.Creator, fmt.Sprintf("Your bounty #%s couldn't be funded and wasn't put up: %s", b.ID, b.Title))
+		return
+	}
+	p.logTip(&tipRecord{ID: funded.ID, From: b.Creator, To: escrowUserId, Amount: b.Amount, Memo: memo, Time: time.Now().UTC()})
+	log.Infof("cointip: recovered bounty #%s escrow tx %s", b.ID, funded.ID)
+	p.dm(b.Creator, fmt.Sprintf("Your bounty is open: %s", p.bountyString(b)))
+}
+
+// listedSince returns true if the oldest listed transaction is older than t, so anything after t is in the list.
+func listedSince(txs []*cointip.Transaction, t time.Time) bool {
+	oldest, err := time.Parse(time.RFC3339, txs[len(txs)-1].CreatedAt)
+	return err == nil && oldest.Before(t)
+}
+
+// updateBounty modifies a bounty that's still in the given status.
+func (p *Plugin) updateBounty(id, status string, fn func(b *bounty)) (*bounty, error) {
+	var updated *bounty
+	err := p.store.Update(bountiesBucket, id, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, fmt.Errorf("no bounty #%s", id)
+		}
+		b := &bounty{}
+		err := json.Unmarshal(value, b)
+		if err != nil {
+			return nil, err
+		}
+		if b.Status != status {
+			return nil, fmt.Errorf("bounty #%s is %s", id, b.Status)
+		}
+		fn(b)
+		updated = b
+		return json.Marshal(b)
+	})
+	return updated, err
+}
+
+// bountyLoop recovers interrupted payouts, on startup and then periodically, and refunds expired bounties.
+func (p *Plugin) bountyLoop(ctx context.Context) {
+	p.recoverBounties()
+
+	ticker := time.NewTicker(bountyCheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.recoverBounties()
+			if p.config.BountyExpiry > 0 {
+				p.expireBounties()
+			}
+		case <-ctx.Done():
+			log.Info("cointip: stopping bounties")
+			return
+		}
+	}
+}
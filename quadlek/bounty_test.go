@@ -0,0 +1,243 @@
+package cointip
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/morgabra/cointip"
+)
+
+// openTestBounty puts up a bounty from creator, moving the funds into escrow.
+func openTestBounty(t *testing.T, p *Plugin, creator string, dollars float64) *bounty {
+	t.Helper()
+	id, err := p.nextId(bountySeqKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bounty{ID: id, Creator: creator, Title: "fix flaky CI", Amount: usd(dollars), Status: bountyOpen, CreatedAt: time.Now().UTC()}
+	tx, err := p.escrowTransfer(creator, escrowUserId, b.Amount, "cointip bounty #"+id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.EscrowTx = tx.ID
+	if err := p.saveBounty(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPayOutBounty(t *testing.T) {
+	p, fc := newTestPlugin(t)
+	addTestUser(t, p, fc, "A", 10)
+	w := addTestUser(t, p, fc, "W", 0)
+	b := openTestBounty(t, p, "A", 5)
+
+	claimed, err := p.claimBounty(b.ID, "W", bountyAwarded, func(b *bounty) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second claim loses
+	if _, err := p.claimBounty(b.ID, "", bountyCancelled, func(b *bounty) error { return nil }); err == nil {
+		t.Fatal("claimed a paying bounty twice")
+	}
+
+	if err := p.payOutBounty(claimed); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := p.getBounty(b.ID)
+	if got.Status != bountyAwarded || got.PaidTo != "W" || got.PayoutTx == "" {
+		t.Fatalf("got %+v", got)
+	}
+	if usd := fc.usd(w.ID); usd != 5 {
+		t.Fatalf("winner got $%.2f, want $5.00", usd)
+	}
+}
+
+func TestPayOutBountyFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status string
+	}{
+		{"refused", &cointip.Error{StatusCode: http.StatusBadRequest, Errors: []cointip.APIError{{ID: "invalid_request"}}}, bountyOpen},
+		{"ambiguous", errors.New("connection reset by peer"), bountyPaying},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, fc := newTestPlugin(t)
+			addTestUser(t, p, fc, "A", 10)
+			addTestUser(t, p, fc, "W", 0)
+			b := openTestBounty(t, p, "A", 5)
+
+			claimed, err := p.claimBounty(b.ID, "W", bountyAwarded, func(b *bounty) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc.transferErr = func(from, to string, amount *cointip.Balance) error { return test.err }
+			if err := p.payOutBounty(claimed); err == nil {
+				t.Fatal("expected the payout to fail")
+			}
+
+			got, _ := p.getBounty(b.ID)
+			if got.Status != test.status {
+				t.Fatalf("got status %s, want %s", got.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestRecoverBounties(t *testing.T) {
+	p, fc := newTestPlugin(t)
+	addTestUser(t, p, fc, "A", 20)
+	w := addTestUser(t, p, fc, "W", 0)
+
+	// One payout went through before the crash, one never started, and one is still in progress
+	paid := openTestBounty(t, p, "A", 5)
+	unpaid := openTestBounty(t, p, "A", 5)
+	recent := openTestBounty(t, p, "A", 5)
+	for _, b := range []*bounty{paid, unpaid, recent} {
+		claimed, err := p.claimBounty(b.ID, "W", bountyAwarded, func(b *bounty) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != recent {
+			claimed.ClaimedAt = time.Now().Add(-time.Hour)
+			p.saveBounty(claimed)
+		}
+		if b == paid {
+			if _, err := p.escrowTransfer(escrowUserId, "W", claimed.Amount, bountyPayoutMemo(claimed)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	p.recoverBounties()
+
+	for _, test := range []struct {
+		b      *bounty
+		status string
+	}{
+		{paid, bountyAwarded},
+		{unpaid, bountyOpen},
+		{recent, bountyPaying},
+	} {
+		got, _ := p.getBounty(test.b.ID)
+		if got.Status != test.status {
+			t.Errorf("bounty #%s: got %s, want %s", got.ID, got.Status, test.status)
+		}
+	}
+	got, _ := p.getBounty(paid.ID)
+	if got.PayoutTx == "" {
+		t.Error("recovered payout has no transaction")
+	}
+	got, _ = p.getBounty(unpaid.ID)
+	if got.PaidTo != "" || got.Payout != "" {
+		t.Errorf("reopened bounty still has a payout: %+v", got)
+	}
+	if usd := fc.usd(w.ID); usd != 5 {
+		t.Fatalf("winner has $%.2f, want only the one $5.00 payout", usd)
+	}
+}
+
+func TestReserveAwardSpend(t *testing.T) {
+	limits := Limits{Currency: cointip.CurrencyUSD, DailyMax: 10, RecipientDailyMax: 6, BlockedPairs: [][2]string{{"A", "X"}}}
+	p, fc := newTestPlugin(t, WithLimits(limits))
+	addTestUser(t, p, fc, "A", 20)
+	b := openTestBounty(t, p, "A", 5)
+	// Putting the bounty up counted toward the daily max already
+	seedSpends(t, p, "A", &spend{Time: time.Now(), Amount: 5})
+
+	if _, err := p.reserveAwardSpend(b, "X"); !isLimitError(err) {
+		t.Fatalf("blocked pair: got %v, want a refusal", err)
+	}
+
+	reserved, err := p.reserveAwardSpend(b, "W")
+	if err != nil || reserved.Amount != 5 || !reserved.RecipientOnly {
+		t.Fatalf("got %+v, %v", reserved, err)
+	}
+
+	// The award counts toward the per recipient cap, but not the daily max twice
+	if _, err := p.reserveRecipientSpend("A", "W", 2); !isLimitError(err) {
+		t.Fatalf("recipient cap: got %v, want a refusal", err)
+	}
+	from, _ := p.getOrCreateAccount("A")
+	if _, err := p.reserveTipSpend(&tipRecord{From: "A", To: "B", Amount: usd(4)}, from); err != nil {
+		t.Fatalf("daily max counted the award: %s", err)
+	}
+}
+
+func TestRecoverFundingBounties(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLimits(Limits{Currency: cointip.CurrencyUSD, DailyMax: 100}))
+	a := addTestUser(t, p, fc, "A", 20)
+
+	// One escrow transfer went through before the crash, one never started, and one is still in progress
+	funding := func(id string, age time.Duration) *bounty {
+		reserved, err := p.reserveTipSpend(&tipRecord{From: "A", Amount: usd(5)}, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &bounty{ID: id, Creator: "A", Title: "fix flaky CI", Amount: usd(5), Status: bountyFunding, CreatedAt: time.Now().Add(-age).UTC(), Spend: reserved.ID}
+		if err := p.saveBounty(b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	funded := funding("1", time.Hour)
+	unfunded := funding("2", time.Hour)
+	recent := funding("3", 0)
+	if _, err := p.escrowTransfer("A", escrowUserId, funded.Amount, bountyEscrowMemo(funded)); err != nil {
+		t.Fatal(err)
+	}
+
+	p.recoverBounties()
+
+	for _, test := range []struct {
+		b      *bounty
+		status string
+	}{
+		{funded, bountyOpen},
+		{unfunded, bountyFailed},
+		{recent, bountyFunding},
+	} {
+		got, _ := p.getBounty(test.b.ID)
+		if got.Status != test.status {
+			t.Errorf("bounty #%s: got %s, want %s", got.ID, got.Status, test.status)
+		}
+	}
+	got, _ := p.getBounty(funded.ID)
+	if got.EscrowTx == "" {
+		t.Error("recovered bounty has no escrow transaction")
+	}
+
+	// The dropped bounty no longer counts against the creator's limits
+	spends, _ := p.loadSpends("A")
+	if len(spends) != 2 {
+		t.Fatalf("got %d spends, want 2", len(spends))
+	}
+	for _, s := range spends {
+		if s.ID == unfunded.Spend {
+			t.Fatalf("dropped bounty still counts: %+v", s)
+		}
+	}
+}
+
+func TestCheckAward(t *testing.T) {
+	p, fc := newTestPlugin(t)
+	addTestUser(t, p, fc, "A", 20)
+	b := openTestBounty(t, p, "A", 5)
+
+	if err := p.checkAward(b, "W"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkAward(b, "A"); !isLimitError(err) {
+		t.Fatalf("award to the creator: got %v, want a refusal", err)
+	}
+
+	p.store.Put(frozenBucket, "A", []byte("abuse"))
+	if err := p.checkAward(b, "W"); !isLimitError(err) {
+		t.Fatalf("frozen creator: got %v, want a refusal", err)
+	}
+}
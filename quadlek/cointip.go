@@ -2,29 +2,38 @@ package cointip
 
 import (
 	"context"
-	"sync"
-
-	"strings"
-
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/jirwin/quadlek/quadlek"
 	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
 )
 
-var coinbaseClient *cointip.ApiKeyClient
-var bankAccount *cointip.Account
-var accountsCache []*cointip.Account
-var accountsCacheLock = &sync.Mutex{}
+func (p *Plugin) setBot(bot *quadlek.Bot) {
+	p.botLock.Lock()
+	defer p.botLock.Unlock()
+	p.bot = bot
+}
 
-func help(cmdMsg *quadlek.CommandMsg) {
-	cmdMsg.Command.Reply() <- &quadlek.CommandResp{
-		Text:      "cointip: Tip your friends!\nAvailable commands: help, balance, deposit, withdraw",
-		InChannel: false,
-	}
+func (p *Plugin) getBot() *quadlek.Bot {
+	p.botLock.Lock()
+	defer p.botLock.Unlock()
+	return p.bot
 }
 
+// Buckets in the store. accounts maps slack user ids to coinbase account ids.
+const (
+	accountsBucket = "accounts"
+	metaBucket     = "meta"
+)
+
+const accountNamePrefix = "cointip_"
+
 func sayError(cmdMsg *quadlek.CommandMsg, msg string, inChannel bool) {
 	cmdMsg.Command.Reply() <- &quadlek.CommandResp{
 		Text:      fmt.Sprintf("Uh Oh. Something broke: %s", msg),
@@ -47,58 +56,140 @@ func accountBalanceString(account *cointip.Account) string {
 	)
 }
 
-func getOrCreateAccount(userId string) (*cointip.Account, error) {
-	log.Infof("cointip: get or create account %s", userId)
-	acctName := fmt.Sprintf("cointip_%s", userId)
+func amountString(amount *cointip.Balance) string {
+	if amount.Currency == cointip.CurrencyBTC {
+		return fmt.Sprintf("%s:%.8f", amount.Currency, amount.Amount)
+	}
+	return fmt.Sprintf("%s:%.2f", amount.Currency, amount.Amount)
+}
 
-	accountsCacheLock.Lock()
-	defer accountsCacheLock.Unlock()
+// migrateAccounts maps existing cointip_<userId> accounts into the store by name. It only runs once per store, after
+// that the store is the source of truth and account names don't matter.
+func (p *Plugin) migrateAccounts() error {
+	migrated, err := p.store.Get(metaBucket, "accounts_migrated")
+	if err != nil {
+		return err
+	}
+	if migrated != nil {
+		return nil
+	}
+
+	log.Info("cointip: migrating accounts - listing accounts")
+	accts, err := p.client.ListAccounts()
+	if err != nil {
+		return err
+	}
 
-	// Warm the cache
-	if len(accountsCache) == 0 {
-		log.Info("cointip: listing accounts")
-		accts, err := coinbaseClient.ListAccounts()
+	found := 0
+	for _, account := range accts {
+		if !strings.HasPrefix(account.Name, accountNamePrefix) {
+			continue
+		}
+		userId := strings.TrimPrefix(account.Name, accountNamePrefix)
+		existing, err := p.store.Get(accountsBucket, userId)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		err = p.store.Put(accountsBucket, userId, []byte(account.ID))
+		if err != nil {
+			return err
 		}
-		accountsCache = accts
-		log.Infof("cointip: found %d accounts", len(accountsCache))
+		found++
 	}
+	log.Infof("cointip: migrated %d of %d accounts", found, len(accts))
 
-	for i, account := range accountsCache {
-		// If we find an account in the cache, we optionally refresh it and return it
-		if account.Name == acctName {
-			log.Infof("cointip: refreshing account %s (%s)", account.Name, account.ID)
-			account, err := coinbaseClient.GetAccount(account.ID)
-			if err != nil {
-				return nil, err
-			}
-			accountsCache[i] = account
+	return p.store.Put(metaBucket, "accounts_migrated", []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// nextId hands out increasing ids from a counter kept in the meta bucket.
+func (p *Plugin) nextId(key string) (string, error) {
+	seq := 0
+	err := p.store.Update(metaBucket, key, func(value []byte) ([]byte, error) {
+		if value != nil {
+			seq, _ = strconv.Atoi(string(value))
+		}
+		seq++
+		return []byte(strconv.Itoa(seq)), nil
+	})
+	return strconv.Itoa(seq), err
+}
+
+// userLocks hands out one mutex per user id. The zero value is ready to use.
+type userLocks struct {
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *userLocks) get(userId string) *sync.Mutex {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]*sync.Mutex{}
+	}
+	m, ok := l.locks[userId]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[userId] = m
+	}
+	return m
+}
+
+// countAccounts returns how many users have an account.
+func (p *Plugin) countAccounts() int {
+	count := 0
+	p.store.ForEach(accountsBucket, func(key string, value []byte) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+func (p *Plugin) getOrCreateAccount(userId string) (*cointip.Account, error) {
+	log.Infof("cointip: get or create account %s", userId)
+	acctName := accountNamePrefix + userId
+
+	p.accountsLock.Lock()
+	defer p.accountsLock.Unlock()
+
+	accountId, err := p.store.Get(accountsBucket, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// If we know the account, refresh and return it
+	if accountId != nil {
+		log.Infof("cointip: refreshing account %s (%s)", userId, accountId)
+		account, err := p.client.GetAccount(string(accountId))
+		if err == nil {
 			return account, nil
 		}
+		if apiErr, ok := err.(*cointip.Error); !ok || apiErr.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+		log.Warnf("cointip: account %s for %s no longer exists, creating a new one", accountId, userId)
 	}
 
-	// Otherwise, create and cache it
+	// Otherwise, create and remember it
 	log.Infof("cointip: creating new account %s", acctName)
-	account, err := coinbaseClient.CreateAccount(acctName)
+	account, err := p.client.CreateAccount(acctName)
+	if err != nil {
+		return nil, err
+	}
+	err = p.store.Put(accountsBucket, userId, []byte(account.ID))
 	if err != nil {
 		return nil, err
 	}
-	accountsCache = append(accountsCache, account)
 	log.Infof("cointip: created new cointip account: %s (%s)", account.Name, account.ID)
 
-	if bankAccount == nil {
-		log.Infof("cointip: skipping account priming - bank account does not exist")
-		return account, nil
-	}
-	tx, err := coinbaseClient.Transfer(bankAccount.ID, account.ID, &cointip.Balance{Currency: cointip.CurrencyUSD, Amount: 3.00})
-	if err != nil {
-		log.WithError(err).Errorf("cointip: failed to prime new cointip account from bank: %s (%s)", bankAccount.Name, bankAccount.ID)
+	if !p.primeAccount(userId, account) {
 		return account, nil
 	}
 
-	log.Infof("cointip: primed new cointip account - refreshing again %s (%s) txid: %s", account.Name, account.ID, tx.ID)
-	refreshed, err := coinbaseClient.GetAccount(account.ID)
+	log.Infof("cointip: refreshing primed account %s (%s)", account.Name, account.ID)
+	refreshed, err := p.client.GetAccount(account.ID)
 	if err != nil {
 		log.WithError(err).Errorf("cointip: failed refreshing new account after priming, returning non-refreshed account: %s", err)
 		return account, err
@@ -106,30 +197,19 @@ func getOrCreateAccount(userId string) (*cointip.Account, error) {
 	return refreshed, nil
 }
 
-func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.ReactionHookMsg) {
+func (p *Plugin) cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.ReactionHookMsg) {
+	p.startBackground(ctx)
 	for {
 		select {
 		case rh := <-reactionChannel:
+			p.setBot(rh.Bot)
 
-			amount := &cointip.Balance{
-				Currency: cointip.CurrencyUSD,
-			}
-			switch rh.Reaction.Reaction {
-			case "cointip_1":
-				amount.Amount = .01
-			case "cointip_2":
-				amount.Amount = .02
-			case "cointip_5":
-				amount.Amount = .05
-			case "cointip_10":
-				amount.Amount = .10
-			case "cointip_25":
-				amount.Amount = .25
-			default:
+			amount := p.reactionAmount(rh.Reaction.Reaction)
+			if amount == nil {
 				continue
 			}
 
-			if bankAccount == nil {
+			if p.bankAccount == nil {
 				log.Info("cointip: ignoring tip reaction - plugin is not initialized")
 				continue
 			}
@@ -140,24 +220,14 @@ func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.Reacti
 				continue
 			}
 
-			from, err := getOrCreateAccount(rh.Reaction.User)
-			if err != nil {
-				log.WithError(err).Error("cointip: tip failed - failed fetching coinbase account.")
-				continue
-			}
-			to, err := getOrCreateAccount(rh.Reaction.ItemUser)
-			if err != nil {
-				log.WithError(err).Error("cointip: tip failed - failed fetching coinbase account.")
-				continue
-			}
-
-			tx, err := coinbaseClient.Transfer(from.ID, to.ID, amount)
-			if err != nil {
-				log.WithError(err).Error("cointip: tip failed - ailed creating transaction.")
-				continue
-			}
-
-			log.Infof("%s (%s) tipped %s (%s) %s:%.2f txid: %s", from.Name, from.ID, to.Name, to.ID, tx.NativeAmount.Currency, tx.NativeAmount.Amount, tx.ID)
+			key := reactionKey(rh.Reaction.User, rh.Reaction.Item.Channel, rh.Reaction.Item.Timestamp, rh.Reaction.Reaction)
+			p.submitReactionTip(key, &tipRecord{
+				From:    rh.Reaction.User,
+				To:      rh.Reaction.ItemUser,
+				Channel: rh.Reaction.Item.Channel,
+				Message: rh.Reaction.Item.Timestamp,
+				Amount:  amount,
+			})
 
 		case <-ctx.Done():
 			log.Info("cointip: stopping reaction hook")
@@ -166,47 +236,62 @@ func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.Reacti
 	}
 }
 
-func cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg) {
+func init() {
+	registerSubcommand(&subcommand{
+		Name: "balance",
+		Help: "Show your tipjar balance",
+		Run:  (*Plugin).balanceCommand,
+	})
+	registerSubcommand(&subcommand{
+		Name: "deposit",
+		Help: "Get an address to deposit BTC into your tipjar",
+		Run:  (*Plugin).depositCommand,
+	})
+}
+
+// /cointip balance
+func (p *Plugin) balanceCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	account, err := p.getOrCreateAccount(cmdMsg.Command.UserId)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	msg := fmt.Sprintf("tipjar balance: %s", p.displayBalance(cmdMsg.Command.UserId, account))
+	if p.config.Ledger {
+		if position := p.ledgerPositionString(cmdMsg.Command.UserId); position != "" {
+			msg += fmt.Sprintf(" (unsettled: %s)", position)
+		}
+	}
+	say(cmdMsg, msg, false)
+}
+
+// /cointip deposit
+func (p *Plugin) depositCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	account, err := p.getOrCreateAccount(cmdMsg.Command.UserId)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	address, err := p.client.CreateAddress(account.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase address.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	//TODO QR code or something for address, also allow coinbase <-> coinbase transfers to dodge fees
+	say(cmdMsg, fmt.Sprintf("deposit address: %s", address.Address), false)
+}
+
+func (p *Plugin) cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg) {
+	p.startBackground(ctx)
 	for {
 		select {
 		case cmdMsg := <-cmdChannel:
-
+			p.setBot(cmdMsg.Bot)
 			// /cointip <command> <args...>
-			cmd := strings.SplitN(cmdMsg.Command.Text, " ", 1)
-			if len(cmd) == 0 {
-				help(cmdMsg)
-				return
-			}
-			log.Infof("cointip: got command %s", cmd[0])
-			switch cmd[0] {
-			case "balance":
-				account, err := getOrCreateAccount(cmdMsg.Command.UserId)
-				if err != nil {
-					log.WithError(err).Error("Failed fetching coinbase account.")
-					sayError(cmdMsg, err.Error(), false)
-					continue
-				}
-				say(cmdMsg, fmt.Sprintf("tipjar balance: %s", accountBalanceString(account)), false)
-			case "deposit":
-				account, err := getOrCreateAccount(cmdMsg.Command.UserId)
-				if err != nil {
-					log.WithError(err).Error("Failed fetching coinbase account.")
-					sayError(cmdMsg, err.Error(), false)
-					continue
-				}
-				address, err := coinbaseClient.CreateAddress(account.ID)
-				if err != nil {
-					log.WithError(err).Error("Failed fetching coinbase address.")
-					sayError(cmdMsg, err.Error(), false)
-					continue
-				}
-				//TODO QR code or something for address, also allow coinbase <-> coinbase transfers to dodge fees
-				say(cmdMsg, fmt.Sprintf("deposit address: %s", address.Address), false)
-			case "withdraw":
-				say(cmdMsg, "withdraw is not implemented yet, sorry!", false)
-			default:
-				help(cmdMsg)
-			}
+			p.route(cmdMsg)
 
 		case <-ctx.Done():
 			log.Info("cointip: stopping plugin")
@@ -215,34 +300,22 @@ func cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg)
 	}
 }
 
-func Register(apiKey, apiSecret, bankAccountId string) quadlek.Plugin {
-	client, err := cointip.APIKeyClient(apiKey, apiSecret)
-	if err != nil {
-		log.WithError(err).Errorf("cointip: failed to create coinbase client, bailing: %s", err)
-		return nil
+// Register makes a plugin from DefaultConfig and opts. Use New to build a Plugin from a Config directly.
+func Register(apiKey, apiSecret, bankAccountId string, opts ...Option) quadlek.Plugin {
+	config := DefaultConfig(apiKey, apiSecret, bankAccountId)
+	for _, opt := range opts {
+		err := opt(config)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: invalid configuration, bailing: %s", err)
+			return nil
+		}
 	}
-	coinbaseClient = client
 
-	// Warm the cache and fetch the bank account
-	account, err := getOrCreateAccount(bankAccountId)
+	p, err := New(config)
 	if err != nil {
-		log.WithError(err).Errorf("cointip: failed to set up bank account, bailing: %s", err)
+		log.WithError(err).Errorf("cointip: failed to start, bailing: %s", err)
 		return nil
 	}
-	bankAccount = account
-
-	log.Infof("cointip: starting plugin bank:%s (%s) %s total_accounts:%d", bankAccount.Name, bankAccount.ID, accountBalanceString(bankAccount), len(accountsCache))
-
-	return quadlek.MakePlugin(
-		"cointip",
-		[]quadlek.Command{
-			quadlek.MakeCommand("cointip", cointipCommand),
-		},
-		nil,
-		[]quadlek.ReactionHook{
-			quadlek.MakeReactionHook(cointipReaction),
-		},
-		nil,
-		nil,
-	)
+
+	return p.QuadlekPlugin()
 }
@@ -0,0 +1,221 @@
+package cointip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five field cron expression: minute hour day-of-month month day-of-week. Each field is a bitset of
+// the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // Cron matches either day field when both are restricted
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both sunday
+}
+
+var weekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 9 * * *",
+	"@weekly":  "0 9 * * 1",
+	"@monthly": "0 9 1 * *",
+}
+
+// The most a schedule can go without running, to catch specs like "0 9 31 2 *" that never match.
+const cronMaxSearch = 5 * 366 * 24 * time.Hour
+
+// parseSchedule parses a cron expression, one of the @daily style shortcuts, or a phrase like "every friday at 17:00",
+// "daily at 9:30", "weekly" or "monthly". Times without an "at" are 09:00.
+func parseSchedule(text string) (*cronSpec, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if shortcut, ok := cronShortcuts[text]; ok {
+		text = shortcut
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 5 && !strings.ContainsAny(fields[0], "abcdefghijklmnopqrstuvwxyz") {
+		return parseCron(fields)
+	}
+
+	expr, err := phraseToCron(fields)
+	if err != nil {
+		return nil, err
+	}
+	return parseCron(strings.Fields(expr))
+}
+
+// phraseToCron turns "every friday at 17:00" into "0 17 * * 5".
+func phraseToCron(words []string) (string, error) {
+	hour, minute := 9, 0
+	if len(words) >= 2 && words[len(words)-2] == "at" {
+		at := strings.SplitN(words[len(words)-1], ":", 2)
+		h, err := strconv.Atoi(at[0])
+		m := 0
+		if err == nil && len(at) == 2 {
+			m, err = strconv.Atoi(at[1])
+		}
+		if err != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+			return "", fmt.Errorf("invalid time %q, use HH:MM", words[len(words)-1])
+		}
+		hour, minute = h, m
+		words = words[:len(words)-2]
+	}
+	if len(words) > 0 && words[0] == "every" {
+		words = words[1:]
+	}
+
+	day := "* * *"
+	switch {
+	case len(words) == 1 && (words[0] == "day" || words[0] == "daily"):
+	case len(words) == 1 && (words[0] == "weekday" || words[0] == "weekdays"):
+		day = "* * 1-5"
+	case len(words) == 1 && (words[0] == "week" || words[0] == "weekly"):
+		day = "* * 1"
+	case len(words) == 1 && (words[0] == "month" || words[0] == "monthly"):
+		day = "1 * *"
+	case len(words) == 1 && len(words[0]) >= 3:
+		dow, ok := weekdays[words[0][:3]]
+		if !ok {
+			return "", fmt.Errorf("unknown schedule %q", strings.Join(words, " "))
+		}
+		day = fmt.Sprintf("* * %d", dow)
+	default:
+		return "", fmt.Errorf("unknown schedule %q, try \"every friday at 17:00\" or a cron expression", strings.Join(words, " "))
+	}
+	return fmt.Sprintf("%d %d %s", minute, hour, day), nil
+}
+
+func parseCron(fields []string) (*cronSpec, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expressions have 5 fields, got %d", len(fields))
+	}
+
+	bits := make([]uint64, 5)
+	for i, field := range cronFields {
+		var err error
+		bits[i], err = parseCronField(fields[i], field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSpec{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		// Like cron, a day field starting with * counts as unrestricted even with a step
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses comma separated values, ranges and steps, e.g. "*", "1-5", "*/15" or "1,15".
+func parseCronField(text string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s %q", field.name, text)
+			}
+			part = part[:i]
+		}
+
+		low, high := field.min, field.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = cronValue(bounds[0])
+			if err == nil {
+				high = low
+				if len(bounds) == 2 {
+					high, err = cronValue(bounds[1])
+				}
+			}
+			if err != nil || low < field.min || high > field.max || low > high {
+				return 0, fmt.Errorf("invalid %s %q", field.name, text)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cronValue parses a number, or a weekday name like fri.
+func cronValue(s string) (int, error) {
+	if dow, ok := weekdays[s]; ok {
+		return dow, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the spec matches in t's time zone, or the zero time if it never does. Times that
+// are skipped by a daylight saving change don't run that day, and times that are repeated run once.
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronMaxSearch)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			// Stepping by wall clock skips the second pass through a repeated hour, unless we're already in it
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+			if !next.After(t) {
+				next = t.Add(time.Minute)
+			}
+			t = next
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,190 @@
+package cointip
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"sometimes",
+		"every fortnight",
+		"every friday at 25:00",
+		"daily at 9:60",
+		"daily at noon",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseSchedule(text); err == nil {
+			t.Errorf("parseSchedule(%q): expected an error", text)
+		}
+	}
+}
+
+func TestPhraseToCron(t *testing.T) {
+	tests := []struct {
+		phrase string
+		cron   string
+	}{
+		{"daily", "0 9 * * *"},
+		{"every day at 9:30", "30 9 * * *"},
+		{"every weekday", "0 9 * * 1-5"},
+		{"weekly", "0 9 * * 1"},
+		{"monthly at 0:00", "0 0 1 * *"},
+		{"every friday at 17:00", "0 17 * * 5"},
+		{"every Sunday at 8", "0 8 * * 0"},
+		{"every thursday", "0 9 * * 4"},
+	}
+	for _, test := range tests {
+		got, err := phraseToCron(strings.Fields(strings.ToLower(test.phrase)))
+		if err != nil || got != test.cron {
+			t.Errorf("phraseToCron(%q): got %q, %v, want %q", test.phrase, got, err, test.cron)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, time.March, 4, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		next string
+	}{
+		{"* * * * *", "2026-03-04 10:31"},
+		{"@hourly", "2026-03-04 11:00"},
+		{"@daily", "2026-03-05 09:00"},
+		{"daily at 10:30", "2026-03-05 10:30"},
+		{"daily at 10:31", "2026-03-04 10:31"},
+		{"*/15 * * * *", "2026-03-04 10:45"},
+		{"0 9-17/4 * * *", "2026-03-04 13:00"},
+		{"0 9 * * 1-5", "2026-03-05 09:00"},
+		{"every friday at 17:00", "2026-03-06 17:00"},
+		{"0 9 * * fri", "2026-03-06 09:00"},
+		{"@weekly", "2026-03-09 09:00"},
+		// Sunday is 0 or 7
+		{"0 0 * * 7", "2026-03-08 00:00"},
+		{"0 0 * * 0", "2026-03-08 00:00"},
+		{"@monthly", "2026-04-01 09:00"},
+		{"0 0 31 * *", "2026-03-31 00:00"},
+		// April has no 31st, so this never matches until the search gives up
+		{"0 0 31 4 *", ""},
+		{"0 0 30 2 *", ""},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		// When both day fields are restricted either one matches
+		{"0 9 1 * fri", "2026-03-06 09:00"},
+		{"0 9 4,5 * mon", "2026-03-05 09:00"},
+		// When one is *, only the other counts
+		{"0 9 * * mon", "2026-03-09 09:00"},
+		{"0 9 10 * *", "2026-03-10 09:00"},
+		// A stepped * still counts as unrestricted, so both have to match: an odd day that's a monday, or
+		// the 1st on a sunday, tuesday, thursday or saturday
+		{"0 0 */2 * 1", "2026-03-09 00:00"},
+		{"0 0 1 * */2", "2026-08-01 00:00"},
+	}
+
+	for _, test := range tests {
+		spec, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %s", test.spec, err)
+			continue
+		}
+		next := spec.next(from)
+		got := ""
+		if !next.IsZero() {
+			got = next.Format("2006-01-02 15:04")
+		}
+		if got != test.next {
+			t.Errorf("%q after %s: got %q, want %q", test.spec, from.Format("2006-01-02 15:04"), got, test.next)
+		}
+	}
+}
+
+func TestCronNextInTimeZone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	spec, _ := parseSchedule("daily at 9:00")
+
+	// 09:00 in Berlin is 08:00 UTC in winter and 07:00 UTC in summer
+	from := time.Date(2026, time.January, 10, 12, 0, 0, 0, time.UTC)
+	if got := spec.next(from.In(berlin)).UTC(); !got.Equal(time.Date(2026, time.January, 11, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("winter: got %s", got)
+	}
+	from = time.Date(2026, time.July, 10, 12, 0, 0, 0, time.UTC)
+	if got := spec.next(from.In(berlin)).UTC(); !got.Equal(time.Date(2026, time.July, 11, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("summer: got %s", got)
+	}
+}
+
+func TestCronNextAcrossDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+
+	// Clocks go from 02:00 to 03:00 on 2026-03-29, so 02:30 doesn't happen that day
+	spec, _ := parseSchedule("30 2 * * *")
+	from := time.Date(2026, time.March, 29, 0, 0, 0, 0, berlin)
+	if got := spec.next(from); got.Format("2006-01-02 15:04") != "2026-03-30 02:30" {
+		t.Errorf("skipped time: got %s", got)
+	}
+
+	// Clocks go from 03:00 back to 02:00 on 2026-10-25, and 02:30 only runs the first time
+	first := spec.next(time.Date(2026, time.October, 25, 0, 0, 0, 0, berlin))
+	second := spec.next(first)
+	if first.Format("2006-01-02 15:04") != "2026-10-25 02:30" || second.Format("2006-01-02 15:04") != "2026-10-26 02:30" {
+		t.Errorf("repeated time: got %s then %s", first, second)
+	}
+
+	// Every minute keeps moving forward through the repeated hour
+	spec, _ = parseSchedule("* * * * *")
+	last := time.Date(2026, time.October, 25, 0, 30, 0, 0, time.UTC).In(berlin) // 02:30 CEST
+	for i := 0; i < 180; i++ {
+		next := spec.next(last)
+		if !next.After(last) {
+			t.Fatalf("next(%s) = %s went backwards", last, next)
+		}
+		last = next
+	}
+}
+
+func TestSplitLocation(t *testing.T) {
+	tests := []struct {
+		text     string
+		when     string
+		location string
+		err      bool
+	}{
+		{"daily at 9:00", "daily at 9:00", "UTC", false},
+		{"daily at 9:00 in Europe/Berlin", "daily at 9:00", "Europe/Berlin", false},
+		{"0 9 * * 1-5 in UTC", "0 9 * * 1-5", "UTC", false},
+		{"daily at 9:00 in Mars/Base", "", "", true},
+	}
+	for _, test := range tests {
+		when, loc, err := splitLocation(test.text)
+		if test.err {
+			if err == nil {
+				t.Errorf("splitLocation(%q): expected an error", test.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Skip("no time zone data:", err)
+		}
+		if when != test.when || loc.String() != test.location {
+			t.Errorf("splitLocation(%q): got %q in %s, want %q in %s", test.text, when, loc, test.when, test.location)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cointip
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Users can pick a currency to see balances and tips in. Amounts in currencies we can't transfer are converted to BTC
+// at coinbase's exchange rates before they're sent.
+const displayCurrencyBucket = "display_currency"
+
+// Rates are cached so a burst of tips doesn't hit the API for each one.
+const ratesTTL = 5 * time.Minute
+
+type cachedRates struct {
+	rates     *cointip.ExchangeRates
+	fetchedAt time.Time
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "currency",
+		Usage: "[code|reset]",
+		Help:  "Show or set the currency you see balances and tips in",
+		Run:   (*Plugin).currencyCommand,
+	})
+}
+
+// rate returns how much of to one unit of from is worth.
+func (p *Plugin) rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	p.ratesLock.Lock()
+	cached, ok := p.rates[from]
+	p.ratesLock.Unlock()
+
+	if !ok || time.Since(cached.fetchedAt) > ratesTTL {
+		rates, err := p.client.GetExchangeRates(from)
+		if err != nil {
+			return 0, fmt.Errorf("failed fetching exchange rates: %w", err)
+		}
+		cached = &cachedRates{rates: rates, fetchedAt: time.Now()}
+
+		p.ratesLock.Lock()
+		p.rates[from] = cached
+		p.ratesLock.Unlock()
+	}
+
+	return cached.rates.Rate(to)
+}
+
+// convert converts an amount into another currency at the current exchange rate.
+func (p *Plugin) convert(amount *cointip.Balance, currency string) (*cointip.Balance, error) {
+	rate, err := p.rate(amount.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &cointip.Balance{Currency: currency, Amount: amount.Amount * rate}, nil
+}
+
+// transferAmount converts amounts coinbase can't transfer into BTC.
+func (p *Plugin) transferAmount(amount *cointip.Balance) (*cointip.Balance, error) {
+	if supportedCurrencies[amount.Currency] {
+		return amount, nil
+	}
+	return p.convert(amount, cointip.CurrencyBTC)
+}
+
+// displayCurrency returns the currency a user picked, or "" if they didn't.
+func (p *Plugin) displayCurrency(userId string) string {
+	value, err := p.store.Get(displayCurrencyBucket, userId)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed fetching display currency for %s", userId)
+		return ""
+	}
+	return string(value)
+}
+
+// displayAmount formats an amount, adding its value in the user's currency if they picked one.
+func (p *Plugin) displayAmount(userId string, amount *cointip.Balance) string {
+	s := amountString(amount)
+	currency := p.displayCurrency(userId)
+	if currency == "" || currency == amount.Currency {
+		return s
+	}
+	converted, err := p.convert(amount, currency)
+	if err != nil {
+		log.WithError(err).Warn("cointip: failed converting amount for display")
+		return s
+	}
+	return fmt.Sprintf("%s (%s)", s, amountString(converted))
+}
+
+// displayBalance formats an account balance, adding its value in the user's currency if they picked one.
+func (p *Plugin) displayBalance(userId string, account *cointip.Account) string {
+	s := accountBalanceString(account)
+	currency := p.displayCurrency(userId)
+	if currency == "" || currency == account.NativeBalance.Currency || currency == account.Balance.Currency {
+		return s
+	}
+	converted, err := p.convert(&account.Balance, currency)
+	if err != nil {
+		log.WithError(err).Warn("cointip: failed converting balance for display")
+		return s
+	}
+	return fmt.Sprintf("%s %s", s, amountString(converted))
+}
+
+// /cointip currency [code|reset]
+func (p *Plugin) currencyCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	userId := cmdMsg.Command.UserId
+	if len(args) == 0 {
+		currency := p.displayCurrency(userId)
+		if currency == "" {
+			currency = "the default"
+		}
+		say(cmdMsg, fmt.Sprintf("you see balances and tips in %s", currency), false)
+		return
+	}
+
+	code := strings.ToUpper(args[0].Text)
+	var err error
+	switch {
+	case code == "RESET":
+		err = p.store.Delete(displayCurrencyBucket, userId)
+	case knownCurrency(code):
+		err = p.store.Put(displayCurrencyBucket, userId, []byte(code))
+	default:
+		codes := []string{}
+		for c := range displayCurrencies {
+			codes = append(codes, c)
+		}
+		for c := range supportedCurrencies {
+			if !displayCurrencies[c] {
+				codes = append(codes, c)
+			}
+		}
+		sort.Strings(codes)
+		say(cmdMsg, fmt.Sprintf("unknown currency %q, try one of %s", args[0].Text, strings.Join(codes, ", ")), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: failed saving display currency")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	if code == "RESET" {
+		say(cmdMsg, "you'll see balances and tips in the default currencies", false)
+		return
+	}
+	say(cmdMsg, fmt.Sprintf("you'll see balances and tips in %s", code), false)
+}
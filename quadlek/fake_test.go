@@ -0,0 +1,236 @@
+package cointip
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/morgabra/cointip"
+)
+
+// fakeBTCPrice is what one BTC is worth in USD on the fake exchange.
+const fakeBTCPrice = 10000.0
+
+// fakeClient is an in-memory coinbase with BTC wallets.
+type fakeClient struct {
+	lock     sync.Mutex
+	seq      int
+	accounts map[string]*cointip.Account
+	txs      map[string][]*cointip.Transaction // By account id, newest first
+
+	// transferErr, if set, can fail a transfer before it happens.
+	transferErr func(from, to string, amount *cointip.Balance) error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		accounts: map[string]*cointip.Account{},
+		txs:      map[string][]*cointip.Transaction{},
+	}
+}
+
+func (c *fakeClient) nextId(prefix string) string {
+	c.seq++
+	return prefix + strconv.Itoa(c.seq)
+}
+
+func (c *fakeClient) addAccount(name string, usd float64) *cointip.Account {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	account := &cointip.Account{
+		ID:            c.nextId("acct-"),
+		Name:          name,
+		Currency:      cointip.CurrencyBTC,
+		Balance:       cointip.Balance{Currency: cointip.CurrencyBTC, Amount: usd / fakeBTCPrice},
+		NativeBalance: cointip.Balance{Currency: cointip.CurrencyUSD, Amount: usd},
+	}
+	c.accounts[account.ID] = account
+	return account
+}
+
+// usd returns an account's balance in USD, rounded to cents.
+func (c *fakeClient) usd(id string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return math.Round(c.accounts[id].Balance.Amount*fakeBTCPrice*100) / 100
+}
+
+func (c *fakeClient) transferCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	count := 0
+	for _, txs := range c.txs {
+		for _, tx := range txs {
+			if tx.Amount.Amount < 0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func notFound() error {
+	return &cointip.Error{StatusCode: http.StatusNotFound, Errors: []cointip.APIError{{ID: "not_found", Message: "Not found"}}}
+}
+
+func (c *fakeClient) GetAuth() (*cointip.Auth, error) {
+	scopes := append([]string{}, cointip.TipScopes...)
+	return &cointip.Auth{Method: "api_key", Scopes: append(scopes, cointip.WithdrawScopes...)}, nil
+}
+
+func (c *fakeClient) ListAccounts() ([]*cointip.Account, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	accounts := []*cointip.Account{}
+	for _, account := range c.accounts {
+		copied := *account
+		accounts = append(accounts, &copied)
+	}
+	return accounts, nil
+}
+
+func (c *fakeClient) GetAccount(id string) (*cointip.Account, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	account, ok := c.accounts[id]
+	if !ok {
+		return nil, notFound()
+	}
+	copied := *account
+	return &copied, nil
+}
+
+func (c *fakeClient) CreateAccount(name string) (*cointip.Account, error) {
+	return c.addAccount(name, 0), nil
+}
+
+func (c *fakeClient) CreateAddress(id string) (*cointip.Address, error) {
+	return &cointip.Address{ID: "addr-" + id, Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"}, nil
+}
+
+func (c *fakeClient) TransferWithDescription(from, to string, amount *cointip.Balance, description string) (*cointip.Transaction, error) {
+	if c.transferErr != nil {
+		if err := c.transferErr(from, to, amount); err != nil {
+			return nil, err
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	src, ok := c.accounts[from]
+	if !ok {
+		return nil, notFound()
+	}
+	dst, ok := c.accounts[to]
+	if !ok {
+		return nil, notFound()
+	}
+
+	btc := amount.Amount
+	switch amount.Currency {
+	case cointip.CurrencyUSD:
+		btc = amount.Amount / fakeBTCPrice
+	case cointip.CurrencyBTC:
+	default:
+		return nil, fmt.Errorf("invalid currency type: %s", amount.Currency)
+	}
+	if src.Balance.Amount < btc-1e-12 {
+		return nil, &cointip.Error{StatusCode: http.StatusBadRequest, Errors: []cointip.APIError{{ID: "insufficient_funds", Message: "Insufficient funds"}}}
+	}
+
+	for _, account := range []*cointip.Account{src, dst} {
+		sign := 1.0
+		if account == src {
+			sign = -1
+		}
+		account.Balance.Amount += sign * btc
+		account.NativeBalance.Amount = account.Balance.Amount * fakeBTCPrice
+	}
+
+	tx := &cointip.Transaction{
+		ID:           c.nextId("tx-"),
+		Type:         "transfer",
+		Status:       "completed",
+		Amount:       cointip.Balance{Currency: cointip.CurrencyBTC, Amount: -btc},
+		NativeAmount: cointip.Balance{Currency: cointip.CurrencyUSD, Amount: -btc * fakeBTCPrice},
+		Description:  description,
+	}
+	received := *tx
+	received.Amount.Amount, received.NativeAmount.Amount = btc, btc*fakeBTCPrice
+	c.txs[from] = append([]*cointip.Transaction{tx}, c.txs[from]...)
+	c.txs[to] = append([]*cointip.Transaction{&received}, c.txs[to]...)
+	return tx, nil
+}
+
+func (c *fakeClient) Withdraw(from, to string, amount *cointip.Balance, opts *cointip.WithdrawOptions) (*cointip.Transaction, error) {
+	return nil, fmt.Errorf("withdraw not implemented")
+}
+
+func (c *fakeClient) ListTransactions(id string, limit int) ([]*cointip.Transaction, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	txs := c.txs[id]
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+	return append([]*cointip.Transaction{}, txs...), nil
+}
+
+func (c *fakeClient) CreateBuy(id, paymentMethod string, amount *cointip.Balance, commit bool) (*cointip.Order, error) {
+	return nil, fmt.Errorf("buys not implemented")
+}
+
+func (c *fakeClient) GetExchangeRates(currency string) (*cointip.ExchangeRates, error) {
+	switch currency {
+	case cointip.CurrencyBTC:
+		return &cointip.ExchangeRates{Currency: currency, Rates: map[string]string{"USD": "10000", "EUR": "8000"}}, nil
+	case cointip.CurrencyUSD:
+		return &cointip.ExchangeRates{Currency: currency, Rates: map[string]string{"BTC": "0.0001", "EUR": "0.8"}}, nil
+	case "EUR":
+		return &cointip.ExchangeRates{Currency: currency, Rates: map[string]string{"BTC": "0.000125", "USD": "1.25"}}, nil
+	}
+	return nil, fmt.Errorf("unknown currency %s", currency)
+}
+
+const testBankUserId = "bank"
+
+// newTestPlugin builds a plugin on a fake coinbase with a $100 bank, no priming and tips made inline.
+func newTestPlugin(t *testing.T, opts ...Option) (*Plugin, *fakeClient) {
+	t.Helper()
+	fc := newFakeClient()
+	fc.addAccount(accountNamePrefix+testBankUserId, 100)
+
+	config := DefaultConfig("", "", testBankUserId)
+	config.Client = fc
+	config.Priming = nil
+	config.TipWorkers = 0
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, fc
+}
+
+// addTestUser gives a user a tipjar holding usd.
+func addTestUser(t *testing.T, p *Plugin, fc *fakeClient, userId string, usd float64) *cointip.Account {
+	t.Helper()
+	account := fc.addAccount(accountNamePrefix+userId, usd)
+	if err := p.store.Put(accountsBucket, userId, []byte(account.ID)); err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func usd(amount float64) *cointip.Balance {
+	return &cointip.Balance{Currency: cointip.CurrencyUSD, Amount: amount}
+}
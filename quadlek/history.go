@@ -0,0 +1,191 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every tip that goes through is appended to the tip log, keyed by time so the bucket is in order.
+const tipLogBucket = "tip_log"
+
+const (
+	historyDefaultCount = 10
+	historyMaxCount     = 50
+)
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "history",
+		Usage: "[n] [sent|received] [page]",
+		Help:  "Show your recent tips, n per page",
+		Run:   (*Plugin).historyCommand,
+	})
+}
+
+func (p *Plugin) logTip(t *tipRecord) {
+	data, err := json.Marshal(t)
+	if err == nil {
+		err = p.store.Put(tipLogBucket, fmt.Sprintf("%020d-%s", t.Time.UnixNano(), t.ID), data)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed logging tip %s", t.ID)
+	}
+}
+
+// loadTipLog returns logged tips matching fn, oldest first.
+func (p *Plugin) loadTipLog(fn func(t *tipRecord) bool) ([]*tipRecord, error) {
+	tips := []*tipRecord{}
+	err := p.store.ForEach(tipLogBucket, func(key string, value []byte) error {
+		t := &tipRecord{}
+		err := json.Unmarshal(value, t)
+		if err != nil {
+			return fmt.Errorf("invalid tip log entry %s: %s", key, err)
+		}
+		if fn(t) {
+			tips = append(tips, t)
+		}
+		return nil
+	})
+	return tips, err
+}
+
+// /cointip history [n] [sent|received] [page]
+func (p *Plugin) historyCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	userId := cmdMsg.Command.UserId
+	count := historyDefaultCount
+	page := 1
+	direction := ""
+
+	numbers := 0
+	for _, arg := range args {
+		switch strings.ToLower(arg.Text) {
+		case "sent", "received":
+			direction = strings.ToLower(arg.Text)
+			continue
+		}
+		n, err := strconv.Atoi(arg.Text)
+		if err != nil || n < 1 || numbers > 1 {
+			sayUsage(cmdMsg, subcommands["history"])
+			return
+		}
+		if numbers == 0 {
+			count = n
+		} else {
+			page = n
+		}
+		numbers++
+	}
+	if count > historyMaxCount {
+		count = historyMaxCount
+	}
+
+	tips, err := p.loadTipLog(func(t *tipRecord) bool {
+		switch direction {
+		case "sent":
+			return t.From == userId
+		case "received":
+			return t.To == userId
+		}
+		return t.From == userId || t.To == userId
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed loading tip log")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	if len(tips) == 0 {
+		if direction == "" && page == 1 {
+			p.coinbaseHistory(cmdMsg, userId, count)
+			return
+		}
+		say(cmdMsg, "no tips yet", false)
+		return
+	}
+
+	pages := (len(tips) + count - 1) / count
+	if page > pages {
+		say(cmdMsg, fmt.Sprintf("there are only %d pages", pages), false)
+		return
+	}
+
+	// Newest first
+	end := len(tips) - (page-1)*count
+	start := end - count
+	if start < 0 {
+		start = 0
+	}
+
+	lines := []string{}
+	for i := end - 1; i >= start; i-- {
+		lines = append(lines, p.historyLine(tips[i], userId))
+	}
+
+	footer := fmt.Sprintf("page %d of %d", page, pages)
+	if page < pages {
+		next := []string{"/cointip history", strconv.Itoa(count)}
+		if direction != "" {
+			next = append(next, direction)
+		}
+		next = append(next, strconv.Itoa(page+1))
+		footer += fmt.Sprintf(" - `%s` for more", strings.Join(next, " "))
+	}
+	lines = append(lines, footer)
+
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+func (p *Plugin) historyLine(t *tipRecord, userId string) string {
+	line := ""
+	if t.From == userId {
+		line = fmt.Sprintf("%s sent %s to <@%s>", t.Time.Format("Jan 2 15:04"), p.displayAmount(userId, t.Amount), t.To)
+	} else {
+		line = fmt.Sprintf("%s got %s from <@%s>", t.Time.Format("Jan 2 15:04"), p.displayAmount(userId, t.Amount), t.From)
+	}
+	if t.Memo != "" {
+		line += fmt.Sprintf(": %s", t.Memo)
+	}
+	return line
+}
+
+// coinbaseHistory lists transactions on the user's account for tips made before the tip log existed. Coinbase doesn't
+// know about slack users, so only descriptions are shown.
+func (p *Plugin) coinbaseHistory(cmdMsg *quadlek.CommandMsg, userId string, count int) {
+	account, err := p.getOrCreateAccount(userId)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	txs, err := p.client.ListTransactions(account.ID, count)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed listing transactions")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(txs) == 0 {
+		say(cmdMsg, "no tips yet", false)
+		return
+	}
+
+	lines := []string{}
+	for _, tx := range txs {
+		when := tx.CreatedAt
+		if t, err := time.Parse(time.RFC3339, tx.CreatedAt); err == nil {
+			when = t.Format("Jan 2 15:04")
+		}
+		line := fmt.Sprintf("%s %s %s", when, amountString(&tx.NativeAmount), tx.Type)
+		if tx.Description != "" {
+			line += fmt.Sprintf(": %s", tx.Description)
+		}
+		lines = append(lines, line)
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
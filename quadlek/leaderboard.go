@@ -0,0 +1,236 @@
+package cointip
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	log "github.com/sirupsen/logrus"
+)
+
+// Leaderboards are computed from the tip log. Reversed tips and their reversals don't count.
+const leaderboardSize = 5
+
+const summaryWeekKey = "summary_week"
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "leaderboard",
+		Usage: "[week|month|all]",
+		Help:  "Show the top tippers, recipients and messages",
+		Run:   (*Plugin).leaderboardCommand,
+	})
+}
+
+type tipStats struct {
+	Count     int
+	Volume    map[string]int64            // Currency -> units
+	Senders   map[string]map[string]int64 // Currency -> user -> units
+	Receivers map[string]map[string]int64 // Currency -> user -> units
+	Messages  map[string]int              // channel/timestamp -> tips
+}
+
+// computeStats computes stats for tips made in [since, until). A zero until means up to now.
+func (p *Plugin) computeStats(since, until time.Time) (*tipStats, error) {
+	tips, err := p.loadTipLog(func(t *tipRecord) bool {
+		return !t.Time.Before(since) && (until.IsZero() || t.Time.Before(until))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reversed := map[string]bool{}
+	for _, t := range tips {
+		if t.Reverses != "" {
+			reversed[t.Reverses] = true
+		}
+	}
+
+	stats := &tipStats{
+		Volume:    map[string]int64{},
+		Senders:   map[string]map[string]int64{},
+		Receivers: map[string]map[string]int64{},
+		Messages:  map[string]int{},
+	}
+	for _, t := range tips {
+		// Moves in and out of escrow, and allowances and transfers from the bank, aren't tips
+		if t.Reverses != "" || reversed[t.ID] || internalUser(t.From) || internalUser(t.To) || t.From == p.bankUserId {
+			continue
+		}
+		units := toUnits(t.Amount)
+		currency := t.Amount.Currency
+
+		stats.Count++
+		stats.Volume[currency] += units
+		if stats.Senders[currency] == nil {
+			stats.Senders[currency] = map[string]int64{}
+			stats.Receivers[currency] = map[string]int64{}
+		}
+		stats.Senders[currency][t.From] += units
+		stats.Receivers[currency][t.To] += units
+		if t.Channel != "" && t.Message != "" {
+			stats.Messages[t.Channel+"/"+t.Message]++
+		}
+	}
+	return stats, nil
+}
+
+type ranked struct {
+	key   string
+	value int64
+}
+
+func top(values map[string]int64) []*ranked {
+	r := []*ranked{}
+	for k, v := range values {
+		r = append(r, &ranked{key: k, value: v})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].value == r[j].value {
+			return r[i].key < r[j].key
+		}
+		return r[i].value > r[j].value
+	})
+	if len(r) > leaderboardSize {
+		r = r[:leaderboardSize]
+	}
+	return r
+}
+
+func sortedCurrencies(volume map[string]int64) []string {
+	currencies := []string{}
+	for currency := range volume {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+func (p *Plugin) statsString(s *tipStats, title string) string {
+	if s.Count == 0 {
+		return fmt.Sprintf("%s: no tips yet", title)
+	}
+
+	currencies := sortedCurrencies(s.Volume)
+	volumes := []string{}
+	for _, currency := range currencies {
+		volumes = append(volumes, amountString(fromUnits(currency, s.Volume[currency])))
+	}
+	lines := []string{fmt.Sprintf("*%s*: %d tips, %s", title, s.Count, strings.Join(volumes, " "))}
+
+	// Amounts in different currencies can't be compared, so each currency gets its own board
+	for _, currency := range currencies {
+		suffix := ""
+		if len(currencies) > 1 {
+			suffix = fmt.Sprintf(" (%s)", currency)
+		}
+		lines = append(lines, fmt.Sprintf("Top tippers%s:", suffix))
+		for i, r := range top(s.Senders[currency]) {
+			lines = append(lines, fmt.Sprintf("%d. <@%s> %s", i+1, r.key, amountString(fromUnits(currency, r.value))))
+		}
+		lines = append(lines, fmt.Sprintf("Top recipients%s:", suffix))
+		for i, r := range top(s.Receivers[currency]) {
+			lines = append(lines, fmt.Sprintf("%d. <@%s> %s", i+1, r.key, amountString(fromUnits(currency, r.value))))
+		}
+	}
+
+	if len(s.Messages) > 0 {
+		messages := map[string]int64{}
+		for k, v := range s.Messages {
+			messages[k] = int64(v)
+		}
+		lines = append(lines, "Most tipped messages:")
+		for i, r := range top(messages) {
+			parts := strings.SplitN(r.key, "/", 2)
+			lines = append(lines, fmt.Sprintf("%d. %s (%d tips)", i+1, p.messageLink(parts[0], parts[1]), r.value))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// /cointip leaderboard [week|month|all]
+func (p *Plugin) leaderboardCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	period := "week"
+	if len(args) > 0 {
+		period = strings.ToLower(args[0].Text)
+	}
+
+	var since time.Time
+	title := ""
+	switch period {
+	case "week":
+		since = time.Now().UTC().AddDate(0, 0, -7)
+		title = "This week"
+	case "month":
+		since = time.Now().UTC().AddDate(0, -1, 0)
+		title = "This month"
+	case "all":
+		title = "All time"
+	default:
+		sayUsage(cmdMsg, subcommands["leaderboard"])
+		return
+	}
+
+	stats, err := p.computeStats(since, time.Time{})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed computing leaderboard")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	say(cmdMsg, p.statsString(stats, title), false)
+}
+
+// postWeeklySummary posts last week's stats once the week is over, once per week.
+func (p *Plugin) postWeeklySummary(now time.Time) {
+	year, week := now.AddDate(0, 0, -7).ISOWeek()
+	weekKey := fmt.Sprintf("%d-%02d", year, week)
+
+	bot := p.getBot()
+	if bot == nil {
+		return
+	}
+
+	// Claim the week first so a failed post isn't repeated every hour
+	posted := false
+	err := p.store.Update(metaBucket, summaryWeekKey, func(value []byte) ([]byte, error) {
+		posted = string(value) == weekKey
+		return []byte(weekKey), nil
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed recording weekly summary")
+		return
+	}
+	if posted {
+		return
+	}
+
+	// Monday 00:00 UTC of the current week back to the one before
+	daysSinceMonday := (int(now.Weekday()) + 6) % 7
+	end := time.Date(now.Year(), now.Month(), now.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	stats, err := p.computeStats(end.AddDate(0, 0, -7), end)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed computing weekly summary")
+		return
+	}
+
+	log.Infof("cointip: posting weekly summary for %s to %s", weekKey, p.config.SummaryChannel)
+	bot.Say(p.config.SummaryChannel, p.statsString(stats, "Last week"))
+}
+
+func (p *Plugin) summaryLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.postWeeklySummary(time.Now().UTC())
+		case <-ctx.Done():
+			log.Info("cointip: stopping weekly summary")
+			return
+		}
+	}
+}
@@ -0,0 +1,676 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// In ledger mode tips are recorded as double-entry ledger entries between users instead of coinbase transfers. Each
+// user has a net position per currency, and positions are settled to coinbase through the bank account on a schedule
+// and before withdraws. Debtors pay the bank and the bank pays creditors, so a settlement costs one transfer per user
+// instead of one per tip. A settlement is recorded before its transfer and finished or reversed once the outcome is
+// known.
+
+const (
+	ledgerBucket        = "ledger"
+	ledgerEntriesBucket = "ledger_entries"
+	ledgerPendingBucket = "ledger_pending" // Settlements recorded before their transfer, until it's confirmed
+	ledgerPositionsKey  = "positions"
+	ledgerEntrySeqKey   = "ledger_entry_seq"
+
+	// Counterparty for settlement entries, its position is what the bank has fronted.
+	ledgerSettlement = "_settlement"
+
+	// Settlements whose transfer can't be found after this long are reversed.
+	ledgerSettleStaleAfter = 10 * time.Minute
+	// How many of an account's transactions are searched for an interrupted settlement.
+	ledgerRecoverTxs = 100
+)
+
+// Amounts are kept in integer minor units so positions don't drift.
+var currencyUnits = map[string]float64{
+	cointip.CurrencyUSD: 100,
+	cointip.CurrencyBTC: 100000000,
+}
+
+func toUnits(amount *cointip.Balance) int64 {
+	return int64(math.Round(amount.Amount * currencyUnits[amount.Currency]))
+}
+
+func fromUnits(currency string, units int64) *cointip.Balance {
+	return &cointip.Balance{Currency: currency, Amount: float64(units) / currencyUnits[currency]}
+}
+
+type ledgerEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Debit    string    `json:"debit"`  // User paying
+	Credit   string    `json:"credit"` // User receiving
+	Currency string    `json:"currency"`
+	Units    int64     `json:"units"`
+	Memo     string    `json:"memo"`
+}
+
+// positions maps user id -> currency -> units.
+type positions map[string]map[string]int64
+
+func (p positions) add(userId, currency string, units int64) {
+	if p[userId] == nil {
+		p[userId] = map[string]int64{}
+	}
+	p[userId][currency] += units
+	if p[userId][currency] == 0 {
+		delete(p[userId], currency)
+	}
+	if len(p[userId]) == 0 {
+		delete(p, userId)
+	}
+}
+
+func (p *Plugin) loadPositions() (positions, error) {
+	pos := positions{}
+	data, err := p.store.Get(ledgerBucket, ledgerPositionsKey)
+	if err != nil || data == nil {
+		return pos, err
+	}
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+// newLedgerEntryId hands out entry ids, zero padded so the store keeps entries in the order they were made.
+func (p *Plugin) newLedgerEntryId() (string, error) {
+	seq, err := p.nextId(ledgerEntrySeqKey)
+	if err != nil {
+		return "", err
+	}
+	n, _ := strconv.Atoi(seq)
+	return fmt.Sprintf("%020d", n), nil
+}
+
+func newLedgerEntry(debit, credit string, amount *cointip.Balance, memo string) *ledgerEntry {
+	return &ledgerEntry{Debit: debit, Credit: credit, Currency: amount.Currency, Units: toUnits(amount), Memo: memo}
+}
+
+// recordLedgerEntry applies an entry to positions and appends it to the ledger, giving it an id if it has none. check,
+// if set, sees the positions the entry applies to and can refuse it, so checks and entries can't interleave.
+func (p *Plugin) recordLedgerEntry(entry *ledgerEntry, check func(pos positions, entry *ledgerEntry) error) error {
+	if entry.Units <= 0 {
+		return fmt.Errorf("amount too small: %s", amountString(fromUnits(entry.Currency, entry.Units)))
+	}
+
+	p.ledgerLock.Lock()
+	defer p.ledgerLock.Unlock()
+
+	if entry.ID == "" {
+		id, err := p.newLedgerEntryId()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+	}
+	entry.Time = time.Now().UTC()
+
+	err := p.store.Update(ledgerBucket, ledgerPositionsKey, func(value []byte) ([]byte, error) {
+		pos := positions{}
+		if value != nil {
+			err := json.Unmarshal(value, &pos)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if check != nil {
+			err := check(pos, entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pos.add(entry.Debit, entry.Currency, -entry.Units)
+		pos.add(entry.Credit, entry.Currency, entry.Units)
+		return json.Marshal(pos)
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.saveLedgerEntry(entry)
+}
+
+func (p *Plugin) saveLedgerEntry(entry *ledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(ledgerEntriesBucket, entry.ID, data)
+}
+
+// ledgerPositionString describes a user's unsettled positions, or "" if there are none.
+func (p *Plugin) ledgerPositionString(userId string) string {
+	pos, err := p.loadPositions()
+	if err != nil || len(pos[userId]) == 0 {
+		return ""
+	}
+
+	currencies := []string{}
+	for currency := range pos[userId] {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	s := ""
+	for _, currency := range currencies {
+		s += fmt.Sprintf(" %s", amountString(fromUnits(currency, pos[userId][currency])))
+	}
+	return s[1:]
+}
+
+// ledgerRate returns how much of to one unit of from is worth, using the rate implied by the account's balances when
+// it can so positions are valued the way coinbase values the balance.
+func (p *Plugin) ledgerRate(account *cointip.Account, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if account.Balance.Amount != 0 {
+		rate := account.NativeBalance.Amount / account.Balance.Amount
+		if from == account.Balance.Currency && to == account.NativeBalance.Currency {
+			return rate, nil
+		}
+		if from == account.NativeBalance.Currency && to == account.Balance.Currency && rate != 0 {
+			return 1 / rate, nil
+		}
+	}
+	return p.rate(from, to)
+}
+
+// ledgerTip records a tip after checking the sender's coinbase balance covers it on top of their unsettled positions.
+// A user's balances and positions in different currencies are the same money, so they're all valued in the tip's
+// currency and checked together.
+func (p *Plugin) ledgerTip(fromUserId, toUserId string, amount *cointip.Balance, memo string) (*ledgerEntry, error) {
+	lock := p.settleLocks.get(fromUserId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Fetched under the settlement lock so a settlement can't move money between reading the balance and the check
+	from, err := p.getOrCreateAccount(fromUserId)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+
+	rates := map[string]float64{}
+	for currency := range currencyUnits {
+		rate, err := p.ledgerRate(from, currency, amount.Currency)
+		if err == nil {
+			rates[currency] = rate
+		}
+	}
+	balanceRate, err := p.ledgerRate(from, from.Balance.Currency, amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Settlements the user may not have paid yet still count against them
+	owed := positions{}
+	pending, err := p.pendingSettlements(fromUserId)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range pending {
+		if s.Entry.Credit == fromUserId {
+			owed.add(fromUserId, s.Entry.Currency, -s.Entry.Units)
+		}
+	}
+
+	entry := newLedgerEntry(fromUserId, toUserId, amount, memo)
+	err = p.recordLedgerEntry(entry, func(pos positions, entry *ledgerEntry) error {
+		total := from.Balance.Amount * balanceRate
+		for _, byCurrency := range []map[string]int64{pos[fromUserId], owed[fromUserId]} {
+			for currency, units := range byCurrency {
+				rate, ok := rates[currency]
+				if !ok {
+					return fmt.Errorf("can't value your %s position in %s right now", currency, entry.Currency)
+				}
+				total += fromUnits(currency, units).Amount * rate
+			}
+		}
+		available := toUnits(&cointip.Balance{Currency: entry.Currency, Amount: total})
+		if available < entry.Units {
+			return refuse("insufficient funds: %s available", amountString(fromUnits(entry.Currency, available)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// pendingSettlement is a settlement entry recorded before its transfer. It's kept until the transfer is confirmed, or
+// reversed if the transfer didn't happen.
+type pendingSettlement struct {
+	Entry      *ledgerEntry     `json:"entry"`
+	User       string           `json:"user"`
+	From       string           `json:"from"` // Coinbase account ids
+	To         string           `json:"to"`
+	Amount     *cointip.Balance `json:"amount"`
+	Since      time.Time        `json:"since"`
+	ReversedBy string           `json:"reversed_by"` // Id of the entry reversing this one, once picked
+}
+
+func (s *pendingSettlement) key() string {
+	return s.User + "/" + s.Entry.ID
+}
+
+func settlementMemo(entry *ledgerEntry) string {
+	return fmt.Sprintf("cointip settlement %s", entry.ID)
+}
+
+func (p *Plugin) savePendingSettlement(s *pendingSettlement) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(ledgerPendingBucket, s.key(), data)
+}
+
+// pendingSettlements returns a user's unconfirmed settlements, or everyone's if userId is "".
+func (p *Plugin) pendingSettlements(userId string) ([]*pendingSettlement, error) {
+	pending := []*pendingSettlement{}
+	err := p.store.ForEach(ledgerPendingBucket, func(key string, value []byte) error {
+		s := &pendingSettlement{}
+		err := json.Unmarshal(value, s)
+		if err != nil {
+			return err
+		}
+		if userId == "" || s.User == userId {
+			pending = append(pending, s)
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// settleUser moves a user's net position in one currency between their account and the bank. Debtors pay the bank,
+// and the bank pays creditors. The position is read under the user's settlement lock, and only settled if allow, when
+// set, accepts it. Returns the units settled.
+func (p *Plugin) settleUser(userId, currency string, allow func(units int64) bool) (int64, error) {
+	lock := p.settleLocks.get(userId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := p.recoverUserSettlements(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	pos, err := p.loadPositions()
+	if err != nil {
+		return 0, err
+	}
+	units := pos[userId][currency]
+	if units == 0 || (allow != nil && !allow(units)) {
+		return 0, nil
+	}
+
+	account, err := p.getOrCreateAccount(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Users that are owed are paid by the bank and debited, users that owe pay the bank and are credited
+	s := &pendingSettlement{User: userId, From: p.bankAccount.ID, To: account.ID, Amount: fromUnits(currency, units), Since: time.Now().UTC()}
+	s.Entry = &ledgerEntry{Debit: userId, Credit: ledgerSettlement, Currency: currency, Units: units, Memo: "settlement pending"}
+	if units < 0 {
+		s.From, s.To = s.To, s.From
+		s.Amount.Amount = -s.Amount.Amount
+		s.Entry.Debit, s.Entry.Credit = ledgerSettlement, userId
+		s.Entry.Units = -units
+	}
+
+	// The entry is recorded before the transfer so a settlement can't be paid twice, and reversed if the transfer fails
+	s.Entry.ID, err = p.newLedgerEntryId()
+	if err != nil {
+		return 0, err
+	}
+	err = p.savePendingSettlement(s)
+	if err != nil {
+		return 0, err
+	}
+	err = p.recordLedgerEntry(s.Entry, nil)
+	if err != nil {
+		p.store.Delete(ledgerPendingBucket, s.key())
+		return 0, err
+	}
+
+	tx, err := p.client.TransferWithDescription(s.From, s.To, s.Amount, settlementMemo(s.Entry))
+	if err != nil {
+		if mayHaveTransferred(&transferError{err}) {
+			return 0, fmt.Errorf("%s - settlement %s will be checked against coinbase before %s is settled again", err, s.Entry.ID, userId)
+		}
+		reverseErr := p.reverseSettlement(s)
+		if reverseErr != nil {
+			log.WithError(reverseErr).Errorf("cointip: failed reversing settlement %s", s.Entry.ID)
+		}
+		return 0, err
+	}
+	p.finishSettlement(s, tx.ID)
+
+	log.Infof("cointip: settled %s %s txid: %s", userId, amountString(fromUnits(currency, units)), tx.ID)
+	return units, nil
+}
+
+// finishSettlement records the transfer that paid a settlement.
+func (p *Plugin) finishSettlement(s *pendingSettlement, txId string) {
+	s.Entry.Memo = fmt.Sprintf("settlement txid: %s", txId)
+	err := p.saveLedgerEntry(s.Entry)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording txid for settlement %s", s.Entry.ID)
+	}
+	err = p.store.Delete(ledgerPendingBucket, s.key())
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed clearing pending settlement %s", s.Entry.ID)
+	}
+}
+
+// reverseSettlement undoes a settlement whose transfer didn't happen. The reversing entry's id is saved first, so
+// retrying after a failure part way through doesn't reverse twice.
+func (p *Plugin) reverseSettlement(s *pendingSettlement) error {
+	if s.ReversedBy == "" {
+		id, err := p.newLedgerEntryId()
+		if err != nil {
+			return err
+		}
+		s.ReversedBy = id
+		err = p.savePendingSettlement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	recorded, err := p.store.Get(ledgerEntriesBucket, s.ReversedBy)
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		reversal := &ledgerEntry{ID: s.ReversedBy, Debit: s.Entry.Credit, Credit: s.Entry.Debit, Currency: s.Entry.Currency, Units: s.Entry.Units, Memo: fmt.Sprintf("reverses settlement %s", s.Entry.ID)}
+		err = p.recordLedgerEntry(reversal, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Entry.Memo = fmt.Sprintf("settlement failed, reversed by %s", s.ReversedBy)
+	err = p.saveLedgerEntry(s.Entry)
+	if err != nil {
+		return err
+	}
+	log.Infof("cointip: reversed settlement %s for %s", s.Entry.ID, s.User)
+	return p.store.Delete(ledgerPendingBucket, s.key())
+}
+
+// recoverUserSettlements finishes or reverses a user's settlements that were interrupted, by looking for their
+// transfer in coinbase. The caller holds the user's settlement lock. Returns an error if any are still unresolved.
+func (p *Plugin) recoverUserSettlements(userId string) error {
+	pending, err := p.pendingSettlements(userId)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	txsByAccount := map[string][]*cointip.Transaction{}
+	unresolved := []string{}
+	for _, s := range pending {
+		recorded, err := p.store.Get(ledgerEntriesBucket, s.Entry.ID)
+		if err != nil {
+			return err
+		}
+		if recorded == nil {
+			// Interrupted before the entry was recorded, so nothing was transferred
+			p.store.Delete(ledgerPendingBucket, s.key())
+			continue
+		}
+		if s.ReversedBy != "" {
+			err := p.reverseSettlement(s)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		txs, ok := txsByAccount[s.From]
+		if !ok {
+			txs, err = p.client.ListTransactions(s.From, ledgerRecoverTxs)
+			if err != nil {
+				return fmt.Errorf("failed checking settlements: %w", err)
+			}
+			txsByAccount[s.From] = txs
+		}
+
+		memo := settlementMemo(s.Entry)
+		var paid *cointip.Transaction
+		for _, tx := range txs {
+			if tx.Description == memo && tx.Amount.Amount < 0 {
+				paid = tx
+				break
+			}
+		}
+		if paid != nil {
+			p.finishSettlement(s, paid.ID)
+			log.Infof("cointip: recovered settlement %s for %s txid: %s", s.Entry.ID, userId, paid.ID)
+			continue
+		}
+
+		// A transfer that isn't listed may still be on its way, or older than anything listed
+		if time.Since(s.Since) < ledgerSettleStaleAfter || (len(txs) >= ledgerRecoverTxs && !listedSince(txs, s.Since)) {
+			unresolved = append(unresolved, s.Entry.ID)
+			continue
+		}
+		err = p.reverseSettlement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return fmt.Errorf("settlements %s for %s haven't been confirmed with coinbase yet", strings.Join(unresolved, ", "), userId)
+	}
+	return nil
+}
+
+// recoverSettlements runs recoverUserSettlements for everyone with a pending settlement, returning what's unresolved.
+func (p *Plugin) recoverSettlements() []string {
+	problems := []string{}
+	pending, err := p.pendingSettlements("")
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed loading pending settlements: %s", err))
+	}
+
+	users := map[string]bool{}
+	for _, s := range pending {
+		if users[s.User] {
+			continue
+		}
+		users[s.User] = true
+
+		lock := p.settleLocks.get(s.User)
+		lock.Lock()
+		err := p.recoverUserSettlements(s.User)
+		lock.Unlock()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// settleUserAll settles every currency for one user, e.g. before they withdraw. It fails if an earlier settlement
+// for the user is still unconfirmed.
+func (p *Plugin) settleUserAll(userId string) error {
+	lock := p.settleLocks.get(userId)
+	lock.Lock()
+	err := p.recoverUserSettlements(userId)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	pos, err := p.loadPositions()
+	if err != nil {
+		return err
+	}
+	for currency := range pos[userId] {
+		_, err := p.settleUser(userId, currency, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleLedger settles every user and reconciles the ledger. Debtors are settled first, and creditors are only paid
+// out of what was collected so the bank doesn't front money for debts that couldn't be collected. Returns settlement
+// failures and reconciliation problems.
+func (p *Plugin) settleLedger() []string {
+	problems := p.recoverSettlements()
+	for _, problem := range problems {
+		log.Warnf("cointip: ledger settlement: %s", problem)
+	}
+
+	pos, err := p.loadPositions()
+	if err != nil {
+		log.WithError(err).Error("cointip: settlement failed - failed loading positions")
+		return append(problems, fmt.Sprintf("failed loading positions: %s", err))
+	}
+
+	collected := map[string]int64{}
+	for userId, byCurrency := range pos {
+		for currency, units := range byCurrency {
+			if userId == ledgerSettlement || units >= 0 {
+				continue
+			}
+			settled, err := p.settleUser(userId, currency, func(units int64) bool { return units < 0 })
+			if err != nil {
+				log.WithError(err).Errorf("cointip: failed settling %s %s", userId, currency)
+				problems = append(problems, fmt.Sprintf("failed settling %s %s: %s", userId, currency, err))
+				continue
+			}
+			collected[currency] += -settled
+		}
+	}
+
+	// Money collected earlier but not paid out yet is available too, anything the bank fronted is paid back first
+	for currency, units := range pos[ledgerSettlement] {
+		collected[currency] -= units
+	}
+
+	for userId, byCurrency := range pos {
+		for currency, units := range byCurrency {
+			if userId == ledgerSettlement || units <= 0 || collected[currency] < units {
+				continue
+			}
+			settled, err := p.settleUser(userId, currency, func(units int64) bool {
+				return units > 0 && collected[currency] >= units
+			})
+			if err != nil {
+				log.WithError(err).Errorf("cointip: failed settling %s %s", userId, currency)
+				problems = append(problems, fmt.Sprintf("failed settling %s %s: %s", userId, currency, err))
+				continue
+			}
+			collected[currency] -= settled
+		}
+	}
+
+	reconciled := p.reconcileLedger()
+	for _, problem := range reconciled {
+		log.Warnf("cointip: ledger reconciliation: %s", problem)
+	}
+	return append(problems, reconciled...)
+}
+
+// reconcileLedger checks the ledger against itself and against coinbase balances, returning any problems found.
+func (p *Plugin) reconcileLedger() []string {
+	problems := []string{}
+
+	pos, err := p.loadPositions()
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed loading positions: %s", err))
+	}
+
+	// Positions must match a replay of the entries, and sum to zero
+	replayed := positions{}
+	err = p.store.ForEach(ledgerEntriesBucket, func(key string, value []byte) error {
+		entry := &ledgerEntry{}
+		err := json.Unmarshal(value, entry)
+		if err != nil {
+			return err
+		}
+		replayed.add(entry.Debit, entry.Currency, -entry.Units)
+		replayed.add(entry.Credit, entry.Currency, entry.Units)
+		return nil
+	})
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed replaying entries: %s", err))
+	}
+
+	totals := map[string]int64{}
+	for userId, byCurrency := range pos {
+		for currency, units := range byCurrency {
+			totals[currency] += units
+			if replayed[userId][currency] != units {
+				problems = append(problems, fmt.Sprintf("%s %s position %d doesn't match entries %d", userId, currency, units, replayed[userId][currency]))
+			}
+		}
+	}
+	for currency, units := range totals {
+		if units != 0 {
+			problems = append(problems, fmt.Sprintf("%s positions sum to %d, not 0", currency, units))
+		}
+	}
+
+	// Every debtor's coinbase balance must cover what they owe
+	for userId, byCurrency := range pos {
+		if userId == ledgerSettlement {
+			continue
+		}
+		account, err := p.getOrCreateAccount(userId)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed fetching account for %s: %s", userId, err))
+			continue
+		}
+		for currency, units := range byCurrency {
+			if units >= 0 {
+				continue
+			}
+			available := account.Balance.Amount
+			if currency == account.NativeBalance.Currency {
+				available = account.NativeBalance.Amount
+			}
+			if owed := fromUnits(currency, -units); available < owed.Amount {
+				problems = append(problems, fmt.Sprintf("%s owes %s but only has %.8f", userId, amountString(owed), available))
+			}
+		}
+	}
+
+	return problems
+}
+
+func (p *Plugin) ledgerSettleLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.config.SettleEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Info("cointip: settling ledger")
+			p.settleLedger()
+		case <-ctx.Done():
+			log.Info("cointip: stopping ledger settlement")
+			return
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package cointip
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestPositionsAdd(t *testing.T) {
+	pos := positions{}
+	pos.add("A", "USD", -60)
+	pos.add("B", "USD", 60)
+	pos.add("A", "BTC", 5)
+	if pos["A"]["USD"] != -60 || pos["B"]["USD"] != 60 || pos["A"]["BTC"] != 5 {
+		t.Fatalf("got %v", pos)
+	}
+
+	// Positions that net out disappear
+	pos.add("A", "USD", 60)
+	pos.add("B", "USD", -60)
+	pos.add("A", "BTC", -5)
+	if len(pos) != 0 {
+		t.Fatalf("netted positions left %v", pos)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		amount *cointip.Balance
+		units  int64
+	}{
+		{usd(0.01), 1},
+		{usd(1.10), 110},
+		{usd(0.29), 29}, // 0.29 * 100 is 28.999999999999996
+		{&cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.00000001}, 1},
+		{&cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.0012345}, 123450},
+	}
+	for _, test := range tests {
+		if units := toUnits(test.amount); units != test.units {
+			t.Errorf("toUnits(%s) = %d, want %d", amountString(test.amount), units, test.units)
+		}
+		if back := fromUnits(test.amount.Currency, test.units); toUnits(back) != test.units {
+			t.Errorf("fromUnits(%d) = %s doesn't round trip", test.units, amountString(back))
+		}
+	}
+}
+
+func TestLedgerTipChecksBalanceAndPosition(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	addTestUser(t, p, fc, "A", 1.00)
+	addTestUser(t, p, fc, "B", 0)
+
+	_, err := p.ledgerTip("A", "B", usd(0.60), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The coinbase balance is still $1, but $0.60 of it is owed
+	_, err = p.ledgerTip("A", "B", usd(0.60), "")
+	if err == nil {
+		t.Fatal("expected a tip beyond the unsettled balance to be refused")
+	}
+	_, err = p.ledgerTip("A", "B", usd(0.40), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos, _ := p.loadPositions()
+	if pos["A"]["USD"] != -100 || pos["B"]["USD"] != 100 {
+		t.Fatalf("positions: got %v", pos)
+	}
+	if n := fc.transferCount(); n != 0 {
+		t.Fatalf("ledger tips made %d coinbase transfers", n)
+	}
+}
+
+func TestLedgerTipConcurrentCantOverdraw(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	addTestUser(t, p, fc, "A", 1.00)
+	addTestUser(t, p, fc, "B", 0)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sent := 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.ledgerTip("A", "B", usd(0.10), ""); err == nil {
+				lock.Lock()
+				sent++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sent != 10 {
+		t.Fatalf("$1.00 covered %d concurrent $0.10 tips, want 10", sent)
+	}
+	pos, _ := p.loadPositions()
+	if pos["A"]["USD"] != -100 {
+		t.Fatalf("A's position: got %d, want -100", pos["A"]["USD"])
+	}
+}
+
+func TestLedgerTipChecksEveryCurrency(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	addTestUser(t, p, fc, "A", 1.00)
+	addTestUser(t, p, fc, "B", 0)
+
+	if _, err := p.ledgerTip("A", "B", usd(1.00), ""); err != nil {
+		t.Fatal(err)
+	}
+	// The BTC balance is the same money that was just tipped in USD
+	btc := &cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.00001}
+	if _, err := p.ledgerTip("A", "B", btc, ""); err == nil {
+		t.Fatal("expected a BTC tip on top of a USD tip of the whole balance to be refused")
+	}
+
+	// B can spend what they're owed in either currency
+	if _, err := p.ledgerTip("B", "A", btc, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ledgerTip("B", "A", usd(0.91), ""); err == nil {
+		t.Fatal("expected B to be refused more than they're owed")
+	}
+	if _, err := p.ledgerTip("B", "A", usd(0.90), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSettleLedger(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	a := addTestUser(t, p, fc, "A", 1.00)
+	b := addTestUser(t, p, fc, "B", 0)
+	c := addTestUser(t, p, fc, "C", 0.50)
+
+	for _, tip := range []struct {
+		fromId  string
+		toId    string
+		dollars float64
+	}{
+		{"A", "B", 0.60},
+		{"C", "B", 0.20},
+		{"A", "C", 0.10},
+	} {
+		if _, err := p.ledgerTip(tip.fromId, tip.toId, usd(tip.dollars), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems := p.settleLedger()
+	if len(problems) != 0 {
+		t.Fatalf("settlement problems: %v", problems)
+	}
+
+	pos, _ := p.loadPositions()
+	if len(pos) != 0 {
+		t.Fatalf("positions after settling: %v", pos)
+	}
+	want := map[string]float64{a.ID: 0.30, b.ID: 0.80, c.ID: 0.40, p.bankAccount.ID: 100}
+	for id, dollars := range want {
+		if got := fc.usd(id); got != dollars {
+			t.Errorf("%s: got $%.2f, want $%.2f", id, got, dollars)
+		}
+	}
+	// One transfer per user, not one per tip
+	if n := fc.transferCount(); n != 3 {
+		t.Errorf("settlement made %d transfers, want 3", n)
+	}
+}
+
+func TestSettleLedgerOnlyPaysWhatWasCollected(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	a := addTestUser(t, p, fc, "A", 1.00)
+	b := addTestUser(t, p, fc, "B", 0)
+
+	if _, err := p.ledgerTip("A", "B", usd(0.50), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A can't be collected from, so B isn't paid out of the bank
+	fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+		if from == a.ID {
+			return &cointip.Error{StatusCode: http.StatusBadRequest, Errors: []cointip.APIError{{ID: "invalid_request"}}}
+		}
+		return nil
+	}
+	problems := p.settleLedger()
+	if len(problems) == 0 {
+		t.Fatal("expected the failed settlement to be reported")
+	}
+	if got := fc.usd(b.ID); got != 0 {
+		t.Fatalf("B was paid $%.2f the bank never collected", got)
+	}
+	pos, _ := p.loadPositions()
+	if pos["A"]["USD"] != -50 || pos["B"]["USD"] != 50 {
+		t.Fatalf("positions after a failed settlement: %v", pos)
+	}
+
+	// Once A can pay, everyone is settled
+	fc.transferErr = nil
+	if problems := p.settleLedger(); len(problems) != 0 {
+		t.Fatalf("settlement problems: %v", problems)
+	}
+	if got := fc.usd(b.ID); got != 0.50 {
+		t.Fatalf("B: got $%.2f, want $0.50", got)
+	}
+	if got := fc.usd(a.ID); got != 0.50 {
+		t.Fatalf("A: got $%.2f, want $0.50", got)
+	}
+}
+
+func TestReconcileLedgerFindsDrift(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	addTestUser(t, p, fc, "A", 1.00)
+	addTestUser(t, p, fc, "B", 0)
+
+	if _, err := p.ledgerTip("A", "B", usd(0.50), ""); err != nil {
+		t.Fatal(err)
+	}
+	if problems := p.reconcileLedger(); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// Positions that don't match the entries, and don't sum to zero
+	p.store.Put(ledgerBucket, ledgerPositionsKey, []byte(`{"A":{"USD":-50},"B":{"USD":60}}`))
+	if problems := p.reconcileLedger(); len(problems) != 2 {
+		t.Fatalf("got problems %v, want 2", problems)
+	}
+}
+
+func TestConcurrentSettlementsPayOnce(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0))
+	addTestUser(t, p, fc, "A", 1.00)
+	b := addTestUser(t, p, fc, "B", 0)
+
+	if _, err := p.ledgerTip("A", "B", usd(0.50), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p.settleUserAll("B")
+		}()
+		go func() {
+			defer wg.Done()
+			p.settleLedger()
+		}()
+	}
+	wg.Wait()
+
+	if got := fc.usd(b.ID); got != 0.50 {
+		t.Fatalf("B: got $%.2f, want $0.50", got)
+	}
+	if problems := p.settleLedger(); len(problems) != 0 {
+		t.Fatalf("settlement problems: %v", problems)
+	}
+}
+
+// ageSettlements makes pending settlements look older than the recovery window.
+func ageSettlements(t *testing.T, p *Plugin) {
+	t.Helper()
+	pending, err := p.pendingSettlements("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range pending {
+		s.Since = s.Since.Add(-2 * ledgerSettleStaleAfter)
+		if err := p.savePendingSettlement(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInterruptedSettlementIsRecovered(t *testing.T) {
+	tests := []struct {
+		name        string
+		transferred bool
+		positionA   int64
+		usdA        float64
+	}{
+		{"transfer went through", true, 0, 0.50},
+		{"transfer never happened", false, -50, 1.00},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, fc := newTestPlugin(t, WithLedger(0))
+			a := addTestUser(t, p, fc, "A", 1.00)
+			addTestUser(t, p, fc, "B", 0)
+			if _, err := p.ledgerTip("A", "B", usd(0.50), ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// The connection drops, so we can't tell if A paid the bank
+			fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+				return errors.New("connection reset by peer")
+			}
+			if _, err := p.settleUser("A", cointip.CurrencyUSD, nil); err == nil {
+				t.Fatal("expected the settlement to fail")
+			}
+			fc.transferErr = nil
+
+			pending, _ := p.pendingSettlements("A")
+			if len(pending) != 1 {
+				t.Fatalf("got %d pending settlements, want 1", len(pending))
+			}
+			if test.transferred {
+				s := pending[0]
+				if _, err := fc.TransferWithDescription(s.From, s.To, s.Amount, settlementMemo(s.Entry)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A can't spend the money they may owe while it's unresolved
+			if _, err := p.ledgerTip("A", "B", usd(0.60), ""); err == nil {
+				t.Fatal("tip spent an unconfirmed settlement")
+			}
+			// A transfer that can be found settles right away, a missing one waits in case it's still on its way
+			if problems := p.recoverSettlements(); (len(problems) == 0) != test.transferred {
+				t.Fatalf("got problems %v", problems)
+			}
+
+			ageSettlements(t, p)
+			if problems := p.recoverSettlements(); len(problems) != 0 {
+				t.Fatalf("got problems %v", problems)
+			}
+			if pending, _ := p.pendingSettlements(""); len(pending) != 0 {
+				t.Fatalf("settlements still pending: %+v", pending)
+			}
+			if problems := p.reconcileLedger(); len(problems) != 0 {
+				t.Fatalf("reconciliation problems: %v", problems)
+			}
+			pos, _ := p.loadPositions()
+			if pos["A"]["USD"] != test.positionA {
+				t.Fatalf("A's position: got %d, want %d", pos["A"]["USD"], test.positionA)
+			}
+			if got := fc.usd(a.ID); got != test.usdA {
+				t.Fatalf("A: got $%.2f, want $%.2f", got, test.usdA)
+			}
+		})
+	}
+}
+
+func TestLedgerEntryIdsAreUnique(t *testing.T) {
+	p, _ := newTestPlugin(t, WithLedger(0))
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		entry := newLedgerEntry("A", "B", usd(0.01), "")
+		if err := p.recordLedgerEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		if seen[entry.ID] {
+			t.Fatalf("entry id %s used twice", entry.ID)
+		}
+		seen[entry.ID] = true
+	}
+	count := 0
+	p.store.ForEach(ledgerEntriesBucket, func(key string, value []byte) error {
+		count++
+		return nil
+	})
+	if count != 100 {
+		t.Fatalf("got %d entries, want 100", count)
+	}
+}
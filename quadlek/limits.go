@@ -0,0 +1,293 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits are anti-abuse rules checked before every tip a user makes. Zero values disable a rule. Amounts are in
+// Currency; tips in other currencies are converted at the sender's account rate.
+type Limits struct {
+	Currency          string
+	MaxTip            float64       // Largest single tip
+	DailyMax          float64       // Most a user can tip in 24 hours
+	WeeklyMax         float64       // Most a user can tip in 7 days
+	RecipientDailyMax float64       // Most a user can tip one recipient in 24 hours
+	Cooldown          time.Duration // Minimum time between tips by a user
+	BlockedPairs      [][2]string   // User id pairs that can't tip each other, in either direction
+	Channels          []string      // Channel ids tips are allowed in, empty for everywhere
+}
+
+const (
+	limitsSpendBucket = "limits_spend"
+	limitsSpendSeqKey = "limits_spend_seq"
+
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+// limitError is a tip refused by a limit. Its message is meant for the sender.
+type limitError struct {
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+func isLimitError(err error) bool {
+	_, ok := err.(*limitError)
+	return ok
+}
+
+func refuse(format string, args ...interface{}) error {
+	return &limitError{reason: fmt.Sprintf(format, args...)}
+}
+
+// spend is a tip counted against a user's limits.
+type spend struct {
+	ID            string    `json:"id"`
+	Time          time.Time `json:"time"`
+	To            string    `json:"to"`
+	Amount        float64   `json:"amount"`         // In the limits currency
+	RecipientOnly bool      `json:"recipient_only"` // Only counts toward the per recipient cap, like awarded bounties
+}
+
+func (p *Plugin) loadSpends(userId string) ([]*spend, error) {
+	spends := []*spend{}
+	data, err := p.store.Get(limitsSpendBucket, userId)
+	if err != nil || data == nil {
+		return spends, err
+	}
+	err = json.Unmarshal(data, &spends)
+	return spends, err
+}
+
+// convertForLimits converts an amount into the limits currency using the rate implied by the sender's balances.
+func (p *Plugin) convertForLimits(amount *cointip.Balance, from *cointip.Account) (float64, error) {
+	if amount.Currency == p.config.Limits.Currency {
+		return amount.Amount, nil
+	}
+	if from.Balance.Amount != 0 {
+		rate := from.NativeBalance.Amount / from.Balance.Amount
+		if amount.Currency == from.Balance.Currency && p.config.Limits.Currency == from.NativeBalance.Currency {
+			return amount.Amount * rate, nil
+		}
+		if amount.Currency == from.NativeBalance.Currency && p.config.Limits.Currency == from.Balance.Currency && rate != 0 {
+			return amount.Amount / rate, nil
+		}
+	}
+	return 0, refuse("can't check %s tips against the %s tipping limits right now", amount.Currency, p.config.Limits.Currency)
+}
+
+func (p *Plugin) limitString(amount float64) string {
+	return amountString(&cointip.Balance{Currency: p.config.Limits.Currency, Amount: amount})
+}
+
+// reserveTipSpend refuses tips that break a limit, and otherwise records the tip as spent before it's sent. Tips that
+// aren't sent are given back with releaseSpend. Returns nil if there are no limits.
+func (p *Plugin) reserveTipSpend(t *tipRecord, from *cointip.Account) (*spend, error) {
+	if p.config.Limits == nil {
+		return nil, nil
+	}
+
+	// Tips that aren't made in a channel, like scheduled tips, aren't held to the channel rule
+	if len(p.config.Limits.Channels) > 0 && t.Channel != "" {
+		allowed := false
+		for _, channel := range p.config.Limits.Channels {
+			allowed = allowed || channel == t.Channel
+		}
+		if !allowed {
+			return nil, refuse("tipping isn't allowed in this channel")
+		}
+	}
+
+	if t.To != "" && p.blockedPair(t.From, t.To) {
+		return nil, refuse("tips between you and <@%s> aren't allowed", t.To)
+	}
+
+	amount, err := p.convertForLimits(t.Amount, from)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.Limits.MaxTip > 0 && amount > p.config.Limits.MaxTip {
+		return nil, refuse("tips are limited to %s each", p.limitString(p.config.Limits.MaxTip))
+	}
+
+	s := &spend{To: t.To, Amount: amount}
+	err = p.reserveSpend(t.From, s, func(spends []*spend) error {
+		now := time.Now()
+		daily, weekly := 0.0, 0.0
+		var last time.Time
+		for _, s := range spends {
+			if s.RecipientOnly {
+				continue
+			}
+			if s.Time.After(last) {
+				last = s.Time
+			}
+			if now.Sub(s.Time) < week {
+				weekly += s.Amount
+			}
+			if now.Sub(s.Time) < day {
+				daily += s.Amount
+			}
+		}
+
+		if p.config.Limits.Cooldown > 0 && now.Sub(last) < p.config.Limits.Cooldown {
+			return refuse("slow down! you can tip again in %s", (p.config.Limits.Cooldown - now.Sub(last)).Round(time.Second))
+		}
+		if p.config.Limits.DailyMax > 0 && daily+amount > p.config.Limits.DailyMax {
+			return refuse("you've tipped %s in the last day, the daily limit is %s", p.limitString(daily), p.limitString(p.config.Limits.DailyMax))
+		}
+		if p.config.Limits.WeeklyMax > 0 && weekly+amount > p.config.Limits.WeeklyMax {
+			return refuse("you've tipped %s in the last week, the weekly limit is %s", p.limitString(weekly), p.limitString(p.config.Limits.WeeklyMax))
+		}
+		if t.To != "" {
+			return p.checkRecipientCap(spends, t.To, amount)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// blockedPair returns true if two users aren't allowed to tip each other.
+func (p *Plugin) blockedPair(a, b string) bool {
+	if p.config.Limits == nil {
+		return false
+	}
+	for _, pair := range p.config.Limits.BlockedPairs {
+		if (pair[0] == a && pair[1] == b) || (pair[0] == b && pair[1] == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveRecipientSpend refuses a tip of amount, in the limits currency, that one user isn't allowed to make to
+// another, and otherwise records it against the per recipient cap only. Tips that go to several recipients, like rain,
+// are reserved as a whole with reserveTipSpend and per recipient here. Returns nil if there are no limits.
+func (p *Plugin) reserveRecipientSpend(from, to string, amount float64) (*spend, error) {
+	if p.config.Limits == nil {
+		return nil, nil
+	}
+	if p.blockedPair(from, to) {
+		return nil, refuse("tips between you and <@%s> aren't allowed", to)
+	}
+	s := &spend{To: to, Amount: amount, RecipientOnly: true}
+	err := p.reserveSpend(from, s, func(spends []*spend) error {
+		return p.checkRecipientCap(spends, to, amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *Plugin) checkRecipientCap(spends []*spend, to string, amount float64) error {
+	if p.config.Limits.RecipientDailyMax <= 0 {
+		return nil
+	}
+	recipient := 0.0
+	for _, s := range spends {
+		if s.To == to && time.Since(s.Time) < day {
+			recipient += s.Amount
+		}
+	}
+	if recipient+amount > p.config.Limits.RecipientDailyMax {
+		return refuse("you've tipped <@%s> %s in the last day, the limit per person is %s", to, p.limitString(recipient), p.limitString(p.config.Limits.RecipientDailyMax))
+	}
+	return nil
+}
+
+// reserveSpend records a spend against a user's limits if check accepts the spends already recorded. Both happen in
+// one store update, so concurrent tips from one user can't all pass the same check. Spends older than the longest
+// window are forgotten.
+func (p *Plugin) reserveSpend(userId string, s *spend, check func(spends []*spend) error) error {
+	id, err := p.nextId(limitsSpendSeqKey)
+	if err != nil {
+		return err
+	}
+	s.ID = id
+	s.Time = time.Now().UTC()
+
+	return p.updateSpends(userId, func(spends []*spend) ([]*spend, error) {
+		if check != nil {
+			err := check(spends)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return append([]*spend{s}, spends...), nil
+	})
+}
+
+// releaseSpend gives back a reserved spend whose tip wasn't sent. A nil spend is ignored.
+func (p *Plugin) releaseSpend(userId string, s *spend) {
+	if s == nil {
+		return
+	}
+	err := p.updateSpends(userId, func(spends []*spend) ([]*spend, error) {
+		kept := []*spend{}
+		for _, old := range spends {
+			if old.ID != s.ID {
+				kept = append(kept, old)
+			}
+		}
+		return kept, nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed releasing spend %s for %s", s.ID, userId)
+	}
+}
+
+// adjustSpend changes the amount of a reserved spend, e.g. when only part of a rain was sent. A nil spend is ignored.
+func (p *Plugin) adjustSpend(userId string, s *spend, amount float64) {
+	if s == nil {
+		return
+	}
+	s.Amount = amount
+	err := p.updateSpends(userId, func(spends []*spend) ([]*spend, error) {
+		for _, old := range spends {
+			if old.ID == s.ID {
+				old.Amount = amount
+			}
+		}
+		return spends, nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed adjusting spend %s for %s", s.ID, userId)
+	}
+}
+
+func (p *Plugin) updateSpends(userId string, fn func(spends []*spend) ([]*spend, error)) error {
+	return p.store.Update(limitsSpendBucket, userId, func(value []byte) ([]byte, error) {
+		spends := []*spend{}
+		if value != nil {
+			err := json.Unmarshal(value, &spends)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		spends, err := fn(spends)
+		if err != nil {
+			return nil, err
+		}
+
+		kept := []*spend{}
+		for _, s := range spends {
+			if time.Since(s.Time) < week {
+				kept = append(kept, s)
+			}
+		}
+		return json.Marshal(kept)
+	})
+}
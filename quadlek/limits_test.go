@@ -0,0 +1,299 @@
+package cointip
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/morgabra/cointip"
+)
+
+// seedSpends replaces a user's recorded spends.
+func seedSpends(t *testing.T, p *Plugin, userId string, spends ...*spend) {
+	t.Helper()
+	data, err := json.Marshal(spends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.store.Put(limitsSpendBucket, userId, data)
+}
+
+func TestCheckTipLimits(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		limits  Limits
+		spends  []*spend
+		tip     *tipRecord
+		refused string // Part of the refusal, empty if the tip is allowed
+	}{
+		{
+			name:   "no limits hit",
+			limits: Limits{MaxTip: 5, DailyMax: 10, WeeklyMax: 20, RecipientDailyMax: 5},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(5)},
+		},
+		{
+			name:    "max tip",
+			limits:  Limits{MaxTip: 5},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(5.01)},
+			refused: "limited to USD:5.00 each",
+		},
+		{
+			name:    "max tip in BTC",
+			limits:  Limits{MaxTip: 5},
+			tip:     &tipRecord{From: "A", To: "B", Amount: &cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.001}},
+			refused: "limited to",
+		},
+		{
+			name:    "daily max",
+			limits:  Limits{DailyMax: 10},
+			spends:  []*spend{{Time: now.Add(-time.Hour), To: "C", Amount: 8}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(3)},
+			refused: "daily limit",
+		},
+		{
+			name:   "daily max forgets yesterday",
+			limits: Limits{DailyMax: 10},
+			spends: []*spend{{Time: now.Add(-25 * time.Hour), To: "C", Amount: 8}},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(3)},
+		},
+		{
+			name:    "weekly max",
+			limits:  Limits{WeeklyMax: 10},
+			spends:  []*spend{{Time: now.Add(-3 * day), To: "C", Amount: 8}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(3)},
+			refused: "weekly limit",
+		},
+		{
+			name:   "weekly max forgets last week",
+			limits: Limits{WeeklyMax: 10},
+			spends: []*spend{{Time: now.Add(-8 * day), To: "C", Amount: 8}},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(3)},
+		},
+		{
+			name:    "recipient daily max",
+			limits:  Limits{RecipientDailyMax: 5},
+			spends:  []*spend{{Time: now.Add(-time.Hour), To: "B", Amount: 4}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(2)},
+			refused: "limit per person",
+		},
+		{
+			name:   "recipient daily max only counts that recipient",
+			limits: Limits{RecipientDailyMax: 5},
+			spends: []*spend{{Time: now.Add(-time.Hour), To: "C", Amount: 4}},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(2)},
+		},
+		{
+			name:    "cooldown",
+			limits:  Limits{Cooldown: time.Minute},
+			spends:  []*spend{{Time: now.Add(-10 * time.Second), To: "C", Amount: 1}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(1)},
+			refused: "slow down",
+		},
+		{
+			name:   "cooldown passed",
+			limits: Limits{Cooldown: time.Minute},
+			spends: []*spend{{Time: now.Add(-2 * time.Minute), To: "C", Amount: 1}},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(1)},
+		},
+		{
+			name:    "blocked pair",
+			limits:  Limits{BlockedPairs: [][2]string{{"A", "B"}}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(1)},
+			refused: "aren't allowed",
+		},
+		{
+			name:    "blocked pair the other way",
+			limits:  Limits{BlockedPairs: [][2]string{{"B", "A"}}},
+			tip:     &tipRecord{From: "A", To: "B", Amount: usd(1)},
+			refused: "aren't allowed",
+		},
+		{
+			name:    "channel not allowed",
+			limits:  Limits{Channels: []string{"C1"}},
+			tip:     &tipRecord{From: "A", To: "B", Channel: "C2", Amount: usd(1)},
+			refused: "isn't allowed in this channel",
+		},
+		{
+			name:   "no channel",
+			limits: Limits{Channels: []string{"C1"}},
+			tip:    &tipRecord{From: "A", To: "B", Amount: usd(1)},
+		},
+		{
+			name:   "channel allowed",
+			limits: Limits{Channels: []string{"C1"}},
+			tip:    &tipRecord{From: "A", To: "B", Channel: "C1", Amount: usd(1)},
+		},
+		{
+			name:    "unconvertible currency",
+			limits:  Limits{MaxTip: 5},
+			tip:     &tipRecord{From: "A", To: "B", Amount: &cointip.Balance{Currency: "EUR", Amount: 1}},
+			refused: "can't check EUR tips",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.limits.Currency = cointip.CurrencyUSD
+			p, fc := newTestPlugin(t, WithLimits(test.limits))
+			from := addTestUser(t, p, fc, "A", 100)
+			seedSpends(t, p, "A", test.spends...)
+
+			_, err := p.reserveTipSpend(test.tip, from)
+			if test.refused == "" {
+				if err != nil {
+					t.Fatalf("refused: %s", err)
+				}
+				return
+			}
+			if !isLimitError(err) || !strings.Contains(err.Error(), test.refused) {
+				t.Fatalf("got %v, want a refusal containing %q", err, test.refused)
+			}
+		})
+	}
+}
+
+func TestTipRecordsSpend(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLimits(Limits{Currency: cointip.CurrencyUSD, DailyMax: 3}))
+	addTestUser(t, p, fc, "A", 100)
+	addTestUser(t, p, fc, "B", 0)
+
+	old := &spend{Time: time.Now().Add(-8 * day), To: "B", Amount: 50}
+	seedSpends(t, p, "A", old)
+
+	for i := 0; i < 3; i++ {
+		if err := p.tip(&tipRecord{From: "A", To: "B", Amount: usd(1)}); err != nil {
+			t.Fatalf("tip %d: %s", i, err)
+		}
+	}
+	err := p.tip(&tipRecord{From: "A", To: "B", Amount: usd(1)})
+	if !isLimitError(err) {
+		t.Fatalf("fourth tip: got %v, want a refusal", err)
+	}
+
+	// Refused tips aren't counted, and spends older than a week are forgotten
+	spends, _ := p.loadSpends("A")
+	if len(spends) != 3 {
+		t.Fatalf("got %d spends, want 3", len(spends))
+	}
+	for _, s := range spends {
+		if s.To != "B" || s.Amount != 1 {
+			t.Errorf("got spend %+v", s)
+		}
+	}
+}
+
+func TestTipWithoutLimitsIsUnchecked(t *testing.T) {
+	p, fc := newTestPlugin(t)
+	from := addTestUser(t, p, fc, "A", 100)
+
+	reserved, err := p.reserveTipSpend(&tipRecord{From: "A", To: "B", Amount: usd(1000)}, from)
+	if err != nil || reserved != nil {
+		t.Fatalf("got %+v, %v", reserved, err)
+	}
+}
+
+func TestCheckRecipientLimits(t *testing.T) {
+	limits := Limits{Currency: cointip.CurrencyUSD, DailyMax: 100, RecipientDailyMax: 5, BlockedPairs: [][2]string{{"A", "C"}}}
+	p, _ := newTestPlugin(t, WithLimits(limits))
+	seedSpends(t, p, "A", &spend{Time: time.Now().Add(-time.Hour), To: "B", Amount: 4})
+
+	tests := []struct {
+		to      string
+		amount  float64
+		refused bool
+	}{
+		{"B", 1, false},
+		{"B", 1.5, true},
+		{"C", 1, true},
+		{"D", 5, false},
+	}
+	for _, test := range tests {
+		reserved, err := p.reserveRecipientSpend("A", test.to, test.amount)
+		if err != nil && !isLimitError(err) {
+			t.Fatal(err)
+		}
+		if (err != nil) != test.refused {
+			t.Errorf("%s %.2f: got %v, want refused %t", test.to, test.amount, err, test.refused)
+		}
+		p.releaseSpend("A", reserved)
+	}
+}
+
+func TestTipsWithoutRecipientSkipRecipientLimits(t *testing.T) {
+	// Rain and bounties are checked as a whole without a recipient, and per recipient with reserveRecipientSpend
+	limits := Limits{Currency: cointip.CurrencyUSD, DailyMax: 10, RecipientDailyMax: 1, BlockedPairs: [][2]string{{"A", ""}}}
+	p, fc := newTestPlugin(t, WithLimits(limits))
+	from := addTestUser(t, p, fc, "A", 100)
+	seedSpends(t, p, "A", &spend{Time: time.Now().Add(-time.Hour), Amount: 4})
+
+	if _, err := p.reserveTipSpend(&tipRecord{From: "A", Amount: usd(5)}, from); err != nil {
+		t.Fatalf("refused: %s", err)
+	}
+	if _, err := p.reserveTipSpend(&tipRecord{From: "A", Amount: usd(2)}, from); !isLimitError(err) {
+		t.Fatalf("got %v, want the daily limit", err)
+	}
+}
+
+func TestConcurrentTipsShareLimits(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLimits(Limits{Currency: cointip.CurrencyUSD, DailyMax: 5}))
+	addTestUser(t, p, fc, "A", 100)
+	to := addTestUser(t, p, fc, "B", 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.tip(&tipRecord{From: "A", To: "B", Amount: usd(1)})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	sent := 0
+	for err := range errs {
+		if err == nil {
+			sent++
+		} else if !isLimitError(err) {
+			t.Fatal(err)
+		}
+	}
+	if sent != 5 || fc.usd(to.ID) != 5 {
+		t.Fatalf("sent %d tips, want 5", sent)
+	}
+}
+
+func TestRefusedTransferGivesLimitsBack(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLimits(Limits{Currency: cointip.CurrencyUSD, DailyMax: 5}))
+	addTestUser(t, p, fc, "A", 100)
+	addTestUser(t, p, fc, "B", 0)
+
+	fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+		return &cointip.Error{StatusCode: http.StatusBadRequest, Errors: []cointip.APIError{{ID: "invalid_request"}}}
+	}
+	if err := p.tip(&tipRecord{From: "A", To: "B", Amount: usd(5)}); err == nil {
+		t.Fatal("expected the transfer to fail")
+	}
+	spends, _ := p.loadSpends("A")
+	if len(spends) != 0 {
+		t.Fatalf("refused transfer still counts: %+v", spends)
+	}
+
+	// A transfer that may have gone through keeps counting
+	fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+		return errors.New("connection reset")
+	}
+	if err := p.tip(&tipRecord{From: "A", To: "B", Amount: usd(5)}); err == nil {
+		t.Fatal("expected the transfer to fail")
+	}
+	spends, _ = p.loadSpends("A")
+	if len(spends) != 1 {
+		t.Fatalf("got %d spends, want the ambiguous transfer counted", len(spends))
+	}
+}
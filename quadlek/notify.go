@@ -0,0 +1,134 @@
+package cointip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jirwin/quadlek/quadlek"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tippers and tippees are told about tips by DM. Users can mute these with /cointip notifications off.
+const notifyMutedBucket = "notify_muted"
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "notifications",
+		Usage: "[on|off]",
+		Help:  "Turn tip DMs on or off",
+		Run:   (*Plugin).notificationsCommand,
+	})
+}
+
+func (p *Plugin) notificationsMuted(userId string) bool {
+	value, err := p.store.Get(notifyMutedBucket, userId)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed checking notification preference for %s", userId)
+		return false
+	}
+	return value != nil
+}
+
+// dm sends a direct message to a user unless they muted notifications. Posting to a user id lands in their DM with
+// the bot.
+func (p *Plugin) dm(userId, msg string) {
+	if p.notificationsMuted(userId) {
+		return
+	}
+	bot := p.getBot()
+	if bot == nil {
+		log.Infof("cointip: skipping DM to %s - no bot yet", userId)
+		return
+	}
+	bot.Say(userId, msg)
+}
+
+// messageLink links to a tipped message, falling back to its channel.
+func (p *Plugin) messageLink(channel, timestamp string) string {
+	if channel == "" {
+		return ""
+	}
+	if p.config.SlackDomain == "" || timestamp == "" {
+		return fmt.Sprintf("<#%s>", channel)
+	}
+	return fmt.Sprintf("https://%s.slack.com/archives/%s/p%s", p.config.SlackDomain, channel, strings.Replace(timestamp, ".", "", 1))
+}
+
+// balanceString is a user's current tipjar balance, including anything unsettled in the ledger.
+func (p *Plugin) balanceString(userId string) string {
+	account, err := p.getOrCreateAccount(userId)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed fetching balance for %s", userId)
+		return "unknown"
+	}
+	balance := p.displayBalance(userId, account)
+	if p.config.Ledger {
+		if position := p.ledgerPositionString(userId); position != "" {
+			balance += fmt.Sprintf(" (unsettled: %s)", position)
+		}
+	}
+	return balance
+}
+
+// notifyTipSent DMs both sides of a tip in the background, so slow balance lookups don't hold up the tip.
+func (p *Plugin) notifyTipSent(t *tipRecord) {
+	tipped := *t
+	go func() {
+		where := ""
+		if link := p.messageLink(tipped.Channel, tipped.Message); link != "" {
+			where = fmt.Sprintf(" for %s", link)
+		}
+		memo := ""
+		if tipped.Memo != "" {
+			memo = fmt.Sprintf(": %s", tipped.Memo)
+		}
+
+		if !p.notificationsMuted(tipped.To) {
+			p.dm(tipped.To, fmt.Sprintf("<@%s> tipped you %s%s%s\ntipjar balance: %s",
+				tipped.From, p.displayAmount(tipped.To, tipped.Amount), where, memo, p.balanceString(tipped.To)))
+		}
+		if !p.notificationsMuted(tipped.From) {
+			p.dm(tipped.From, fmt.Sprintf("You tipped <@%s> %s%s%s\ntipjar balance: %s",
+				tipped.To, p.displayAmount(tipped.From, tipped.Amount), where, memo, p.balanceString(tipped.From)))
+		}
+	}()
+}
+
+// notifyTipFailed tells the sender a tip they didn't get a reply for didn't go through.
+func (p *Plugin) notifyTipFailed(t *tipRecord, reason string) {
+	where := ""
+	if link := p.messageLink(t.Channel, t.Message); link != "" {
+		where = fmt.Sprintf(" for %s", link)
+	}
+	p.dm(t.From, fmt.Sprintf("Your tip of %s to <@%s>%s didn't go through: %s", p.displayAmount(t.From, t.Amount), t.To, where, reason))
+}
+
+// /cointip notifications [on|off]
+func (p *Plugin) notificationsCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	userId := cmdMsg.Command.UserId
+	if len(args) == 0 {
+		state := "on"
+		if p.notificationsMuted(userId) {
+			state = "off"
+		}
+		say(cmdMsg, fmt.Sprintf("tip notifications are %s", state), false)
+		return
+	}
+
+	var err error
+	switch strings.ToLower(args[0].Text) {
+	case "on":
+		err = p.store.Delete(notifyMutedBucket, userId)
+	case "off":
+		err = p.store.Put(notifyMutedBucket, userId, []byte("1"))
+	default:
+		sayUsage(cmdMsg, subcommands["notifications"])
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: failed saving notification preference")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	say(cmdMsg, fmt.Sprintf("tip notifications turned %s", strings.ToLower(args[0].Text)), false)
+}
@@ -0,0 +1,132 @@
+package cointip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/morgabra/cointip"
+)
+
+// Option changes the configuration Register starts from.
+type Option func(c *Config) error
+
+// WithReactions replaces the default reaction to amount mapping, e.g. {"taco": {Currency: "USD", Amount: 0.50}}.
+func WithReactions(reactions map[string]cointip.Balance) Option {
+	return func(c *Config) error {
+		c.Reactions = reactions
+		return nil
+	}
+}
+
+// WithReactionPatterns adds reactions that encode their amount in the name, like cointip_<n>.
+func WithReactionPatterns(patterns ...ReactionPattern) Option {
+	return func(c *Config) error {
+		c.ReactionPatterns = patterns
+		return nil
+	}
+}
+
+// WithStore persists plugin state, like which coinbase account belongs to which user, in s. Defaults to an in-memory
+// store.
+func WithStore(s Store) Option {
+	return func(c *Config) error {
+		c.Store = s
+		return nil
+	}
+}
+
+// WithLedger records tips in a local ledger instead of transferring on every tip. Net positions are settled to coinbase
+// every settleEvery, and before a user withdraws. A settleEvery of 0 only settles on withdraw.
+func WithLedger(settleEvery time.Duration) Option {
+	return func(c *Config) error {
+		c.Ledger = true
+		c.SettleEvery = settleEvery
+		return nil
+	}
+}
+
+// WithTipWorkers sets how many workers process queued reaction tips, and how many times a failing tip is tried before
+// it is dead-lettered. Defaults to 4 workers and 5 attempts. 0 workers tips inline in the reaction hook.
+func WithTipWorkers(workers, maxAttempts int) Option {
+	return func(c *Config) error {
+		if workers < 0 || maxAttempts < 1 {
+			return fmt.Errorf("invalid tip workers %d or attempts %d", workers, maxAttempts)
+		}
+		c.TipWorkers = workers
+		c.TipMaxAttempts = maxAttempts
+		return nil
+	}
+}
+
+// WithTipReversal reverses reaction tips when the reaction is removed within grace. With delayedCommit tips are held
+// for grace before being sent, so removing the reaction cancels them instead.
+func WithTipReversal(grace time.Duration, delayedCommit bool) Option {
+	return func(c *Config) error {
+		if grace <= 0 {
+			return fmt.Errorf("tip reversal grace must be positive, got %s", grace)
+		}
+		c.ReversalGrace = grace
+		c.ReversalDelayedCommit = delayedCommit
+		return nil
+	}
+}
+
+// WithLimits enforces spending limits and anti-abuse rules on every tip.
+func WithLimits(l Limits) Option {
+	return func(c *Config) error {
+		c.Limits = &l
+		return nil
+	}
+}
+
+// WithPriming changes how much new users get from the bank, and who is eligible. nil turns priming off.
+func WithPriming(p *Priming) Option {
+	return func(c *Config) error {
+		c.Priming = p
+		return nil
+	}
+}
+
+// WithBankMonitor alerts an ops channel when the bank runs low, and optionally tops it up.
+func WithBankMonitor(m BankMonitor) Option {
+	return func(c *Config) error {
+		c.BankMonitor = &m
+		return nil
+	}
+}
+
+// WithBountyExpiry refunds open bounties to their creator after d. Defaults to 30 days, 0 never expires them.
+func WithBountyExpiry(d time.Duration) Option {
+	return func(c *Config) error {
+		c.BountyExpiry = d
+		return nil
+	}
+}
+
+// WithAdmins lets the given slack user ids run /cointip admin commands.
+func WithAdmins(userIds ...string) Option {
+	return func(c *Config) error {
+		c.Admins = append(c.Admins, userIds...)
+		return nil
+	}
+}
+
+// WithSlackDomain sets the workspace domain (<domain>.slack.com) so tip DMs can link to the tipped message.
+func WithSlackDomain(domain string) Option {
+	return func(c *Config) error {
+		c.SlackDomain = strings.TrimSuffix(domain, ".slack.com")
+		return nil
+	}
+}
+
+// WithWeeklySummary posts last week's leaderboard to a channel every Monday.
+func WithWeeklySummary(channel string) Option {
+	return func(c *Config) error {
+		if channel == "" {
+			return fmt.Errorf("weekly summary channel is required")
+		}
+		c.SummaryChannel = channel
+		return nil
+	}
+}
@@ -0,0 +1,256 @@
+package cointip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Client is the part of the coinbase API the plugin uses. *cointip.ApiKeyClient implements it.
+type Client interface {
+	GetAuth() (*cointip.Auth, error)
+	ListAccounts() ([]*cointip.Account, error)
+	GetAccount(id string) (*cointip.Account, error)
+	CreateAccount(name string) (*cointip.Account, error)
+	CreateAddress(id string) (*cointip.Address, error)
+	TransferWithDescription(from, to string, amount *cointip.Balance, description string) (*cointip.Transaction, error)
+	Withdraw(from, to string, amount *cointip.Balance, opts *cointip.WithdrawOptions) (*cointip.Transaction, error)
+	ListTransactions(id string, limit int) ([]*cointip.Transaction, error)
+	CreateBuy(id, paymentMethod string, amount *cointip.Balance, commit bool) (*cointip.Order, error)
+	GetExchangeRates(currency string) (*cointip.ExchangeRates, error)
+}
+
+// Config is everything a Plugin needs. Zero values turn features off; DefaultConfig has the defaults Register uses.
+type Config struct {
+	APIKey    string
+	APISecret string
+	Client    Client // Used instead of an API key client if set
+
+	// The bank is the tipjar of this user id. It primes new users and settles the ledger.
+	BankAccountId string
+
+	Reactions        map[string]cointip.Balance // nil for DefaultReactions
+	ReactionPatterns []ReactionPattern          // DefaultConfig has DefaultReactionPatterns
+	Priming          *Priming
+	Limits           *Limits
+	Store            Store // Defaults to a MemoryStore
+	BankMonitor      *BankMonitor
+
+	Ledger      bool          // Record tips in a local ledger instead of transferring on every tip
+	SettleEvery time.Duration // How often the ledger is settled. 0 only settles on withdraw
+
+	TipWorkers     int // Workers processing queued reaction tips. 0 tips inline in the reaction hook
+	TipMaxAttempts int // Attempts before a queued tip is dead-lettered
+
+	ReversalGrace         time.Duration // Reverse reaction tips when the reaction is removed within this long
+	ReversalDelayedCommit bool          // Hold reaction tips for ReversalGrace instead of reversing them
+
+	Admins         []string // Slack user ids allowed to run /cointip admin
+	SlackDomain    string   // <domain>.slack.com, for linking to tipped messages
+	SummaryChannel string   // Channel to post last week's leaderboard to every Monday
+
+	BountyExpiry time.Duration // Open bounties are refunded to their creator after this long. 0 never expires them
+}
+
+// DefaultConfig is the configuration Register starts from.
+func DefaultConfig(apiKey, apiSecret, bankAccountId string) *Config {
+	priming := DefaultPriming
+	return &Config{
+		APIKey:           apiKey,
+		APISecret:        apiSecret,
+		BankAccountId:    bankAccountId,
+		Reactions:        DefaultReactions,
+		ReactionPatterns: DefaultReactionPatterns,
+		Priming:          &priming,
+		TipWorkers:       4,
+		TipMaxAttempts:   5,
+		BountyExpiry:     30 * 24 * time.Hour,
+	}
+}
+
+func (c *Config) validate() error {
+	if c.BankAccountId == "" {
+		return fmt.Errorf("bank account id is required")
+	}
+	for name, amount := range c.Reactions {
+		if !supportedCurrencies[amount.Currency] || amount.Amount <= 0 {
+			return fmt.Errorf("invalid amount for reaction %s: %s:%f", name, amount.Currency, amount.Amount)
+		}
+	}
+	if c.Priming != nil && (!supportedCurrencies[c.Priming.Amount.Currency] || c.Priming.Amount.Amount <= 0) {
+		return fmt.Errorf("invalid priming amount %s:%f", c.Priming.Amount.Currency, c.Priming.Amount.Amount)
+	}
+	if c.Limits != nil && !supportedCurrencies[c.Limits.Currency] {
+		return fmt.Errorf("unsupported limits currency %q", c.Limits.Currency)
+	}
+	if c.TipWorkers < 0 || (c.TipWorkers > 0 && c.TipMaxAttempts < 1) {
+		return fmt.Errorf("invalid tip workers %d or attempts %d", c.TipWorkers, c.TipMaxAttempts)
+	}
+	if c.BankMonitor != nil {
+		err := c.BankMonitor.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.BountyExpiry < 0 {
+		return fmt.Errorf("bounty expiry can't be negative, got %s", c.BountyExpiry)
+	}
+	if c.ReversalGrace < 0 {
+		return fmt.Errorf("tip reversal grace can't be negative, got %s", c.ReversalGrace)
+	}
+	return nil
+}
+
+// Plugin is one cointip instance: a coinbase client, a bank and a store. Several can run side by side, e.g. one per
+// workspace, as long as they don't share a store.
+type Plugin struct {
+	config *Config
+	client Client
+	store  Store
+
+	bankAccount  *cointip.Account
+	bankUserId   string
+	accountsLock sync.Mutex
+
+	// The bot is only handed to us with messages, so hang on to the latest one for lookups outside of handlers.
+	bot     *quadlek.Bot
+	botLock sync.Mutex
+
+	reactionPatterns []*ReactionPattern
+	admins           map[string]bool
+	ledgerLock       sync.Mutex
+	settleLocks      userLocks // Held while a user's balance is checked against or settled with the ledger
+	tipQueue         *queue
+
+	rates     map[string]*cachedRates
+	ratesLock sync.Mutex
+
+	activity     map[string]time.Time // Last time each user's activity was written to the store
+	activityLock sync.Mutex
+
+	pendingWithdraws     map[string]*pendingWithdraw
+	pendingWithdrawsLock sync.Mutex
+
+	backgroundJobs []func(ctx context.Context)
+	backgroundOnce sync.Once
+}
+
+// New checks the configuration and coinbase credentials, and sets up the bank account.
+func New(config *Config) (*Plugin, error) {
+	if config.Reactions == nil {
+		config.Reactions = DefaultReactions
+	}
+	if config.Limits != nil && config.Limits.Currency == "" {
+		config.Limits.Currency = cointip.CurrencyUSD
+	}
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plugin{
+		config:           config,
+		client:           config.Client,
+		store:            config.Store,
+		admins:           map[string]bool{},
+		rates:            map[string]*cachedRates{},
+		activity:         map[string]time.Time{},
+		pendingWithdraws: map[string]*pendingWithdraw{},
+	}
+	if p.store == nil {
+		p.store = NewMemoryStore()
+	}
+	for _, userId := range config.Admins {
+		p.admins[userId] = true
+	}
+	for i := range config.ReactionPatterns {
+		pattern := config.ReactionPatterns[i]
+		err := pattern.compile()
+		if err != nil {
+			return nil, err
+		}
+		p.reactionPatterns = append(p.reactionPatterns, &pattern)
+	}
+
+	if p.client == nil {
+		client, err := cointip.APIKeyClient(config.APIKey, config.APISecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create coinbase client: %s", err)
+		}
+		p.client = client
+	}
+
+	// Make sure the API key can actually do what we need before the first tip fails
+	auth, err := p.client.GetAuth()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch api key permissions: %s", err)
+	}
+	if missing := auth.MissingScopes(cointip.TipScopes); len(missing) > 0 {
+		return nil, fmt.Errorf("api key is missing permissions required for tipping: %s", strings.Join(missing, ", "))
+	}
+	if missing := auth.MissingScopes(cointip.WithdrawScopes); len(missing) > 0 {
+		log.Warnf("cointip: api key is missing permissions required for withdrawing: %s", strings.Join(missing, ", "))
+	}
+
+	err = p.migrateAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate accounts: %s", err)
+	}
+
+	// Fetch the bank account
+	account, err := p.getOrCreateAccount(config.BankAccountId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up bank account: %s", err)
+	}
+	p.bankAccount = account
+	p.bankUserId = config.BankAccountId
+
+	if config.Ledger && config.SettleEvery > 0 {
+		p.registerBackground(p.ledgerSettleLoop)
+	}
+	if config.TipWorkers > 0 {
+		p.tipQueue = newTipQueue(p, config.TipWorkers)
+		p.registerBackground(p.tipQueue.run)
+	}
+	if config.ReversalGrace > 0 {
+		p.registerBackground(p.reversalLoop)
+	}
+	if config.SummaryChannel != "" {
+		p.registerBackground(p.summaryLoop)
+	}
+	if config.BankMonitor != nil {
+		p.registerBackground(p.bankMonitorLoop)
+	}
+	if config.Priming != nil {
+		p.registerBackground(p.primingRetryLoop)
+	}
+	p.registerBackground(p.bountyLoop)
+	p.registerBackground(p.scheduleLoop)
+
+	log.Infof("cointip: starting plugin bank:%s (%s) %s total_accounts:%d", p.bankAccount.Name, p.bankAccount.ID, accountBalanceString(p.bankAccount), p.countAccounts())
+	return p, nil
+}
+
+// QuadlekPlugin wires the plugin's command and reaction hook into quadlek.
+func (p *Plugin) QuadlekPlugin() quadlek.Plugin {
+	return quadlek.MakePlugin(
+		"cointip",
+		[]quadlek.Command{
+			quadlek.MakeCommand("cointip", p.cointipCommand),
+		},
+		[]quadlek.Hook{
+			quadlek.MakeHook(p.activityHook),
+		},
+		[]quadlek.ReactionHook{
+			quadlek.MakeReactionHook(p.cointipReaction),
+		},
+		nil,
+		nil,
+	)
+}
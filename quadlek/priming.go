@@ -0,0 +1,211 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Priming seeds new tipjars from the bank so new users have something to tip with.
+type Priming struct {
+	Amount      cointip.Balance
+	Budget      float64 // Most the bank will ever prime in total, in Amount.Currency. 0 for no limit
+	AllowBots   bool
+	AllowGuests bool // Single and multi-channel guests
+}
+
+// DefaultPriming gives each new human, non-guest user $3.00.
+var DefaultPriming = Priming{
+	Amount: cointip.Balance{Currency: cointip.CurrencyUSD, Amount: 3.00},
+}
+
+const (
+	primedBucket         = "primed"
+	primingPendingBucket = "priming_pending"
+	primingSpentKey      = "priming_spent"
+
+	// Users who couldn't be looked up in slack are retried this often, for this long
+	primingRetryEvery = time.Minute
+	primingRetryFor   = 7 * day
+)
+
+type primed struct {
+	Time   time.Time        `json:"time"`
+	Amount *cointip.Balance `json:"amount"`
+	TxID   string           `json:"txid"`
+}
+
+// primingEligible checks slack to see if a user should be primed, returning why not if they shouldn't. An error means
+// the user couldn't be looked up.
+func (p *Plugin) primingEligible(userId string) (string, error) {
+	bot := p.getBot()
+	if bot == nil {
+		return "", fmt.Errorf("can't look up slack user yet")
+	}
+	user, err := bot.GetUser(userId)
+	if err != nil {
+		return "", fmt.Errorf("failed looking up slack user: %s", err)
+	}
+	if user.Deleted {
+		return "user is deactivated", nil
+	}
+	if user.IsBot && !p.config.Priming.AllowBots {
+		return "user is a bot", nil
+	}
+	if (user.IsRestricted || user.IsUltraRestricted) && !p.config.Priming.AllowGuests {
+		return "user is a guest", nil
+	}
+	return "", nil
+}
+
+// reservePriming takes the priming amount out of the budget, or returns an error if it's spent.
+func (p *Plugin) reservePriming(amount float64) error {
+	if p.config.Priming.Budget <= 0 {
+		return nil
+	}
+	return p.store.Update(metaBucket, primingSpentKey, func(value []byte) ([]byte, error) {
+		spent := 0.0
+		if value != nil {
+			var err error
+			spent, err = strconv.ParseFloat(string(value), 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if spent+amount > p.config.Priming.Budget {
+			return nil, fmt.Errorf("priming budget spent (%.2f of %.2f)", spent, p.config.Priming.Budget)
+		}
+		return []byte(strconv.FormatFloat(spent+amount, 'f', -1, 64)), nil
+	})
+}
+
+// primeAccount moves the priming amount from the bank to a new user's account, once per user ever. Returns true if
+// the account was primed. Users who can't be looked up in slack are left pending and retried by primingRetryLoop.
+func (p *Plugin) primeAccount(userId string, account *cointip.Account) bool {
+	if p.config.Priming == nil || internalUser(userId) {
+		return false
+	}
+	if p.bankAccount == nil || account.ID == p.bankAccount.ID {
+		log.Infof("cointip: skipping account priming - bank account does not exist")
+		return false
+	}
+
+	pending := false
+	defer func() {
+		if !pending {
+			p.store.Delete(primingPendingBucket, userId)
+		}
+	}()
+
+	already, err := p.store.Get(primedBucket, userId)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: skipping account priming - failed checking if %s was primed", userId)
+		return false
+	}
+	if already != nil {
+		log.Infof("cointip: skipping account priming - %s was already primed", userId)
+		return false
+	}
+
+	reason, err := p.primingEligible(userId)
+	if err != nil {
+		log.WithError(err).Warnf("cointip: deferring account priming for %s", userId)
+		pending = p.deferPriming(userId)
+		return false
+	}
+	if reason != "" {
+		log.Infof("cointip: skipping account priming for %s - %s", userId, reason)
+		return false
+	}
+
+	err = p.reservePriming(p.config.Priming.Amount.Amount)
+	if err != nil {
+		log.WithError(err).Warnf("cointip: skipping account priming for %s", userId)
+		return false
+	}
+
+	amount := &cointip.Balance{Currency: p.config.Priming.Amount.Currency, Amount: p.config.Priming.Amount.Amount}
+	tx, err := p.client.TransferWithDescription(p.bankAccount.ID, account.ID, amount, "cointip priming")
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed to prime new cointip account from bank: %s (%s)", p.bankAccount.Name, p.bankAccount.ID)
+		if cointip.IsInsufficientFunds(err) && p.due(bankLowAlertKey, bankAlertEvery) {
+			p.opsAlert("bank %s (%s) can't cover priming %s for <@%s>", p.bankAccount.Name, p.bankAccount.ID, amountString(amount), userId)
+		}
+		// Give the reservation back
+		if p.config.Priming.Budget > 0 {
+			p.reservePriming(-amount.Amount)
+		}
+		return false
+	}
+
+	data, err := json.Marshal(&primed{Time: time.Now().UTC(), Amount: amount, TxID: tx.ID})
+	if err == nil {
+		err = p.store.Put(primedBucket, userId, data)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording priming for %s, they may be primed again", userId)
+	}
+
+	log.Infof("cointip: primed new cointip account %s (%s) %s txid: %s", account.Name, account.ID, amountString(amount), tx.ID)
+	return true
+}
+
+// deferPriming marks a user to be primed later, keeping the time they were first deferred. Returns false if the
+// marker couldn't be saved.
+func (p *Plugin) deferPriming(userId string) bool {
+	err := p.store.Update(primingPendingBucket, userId, func(value []byte) ([]byte, error) {
+		if value != nil {
+			return value, nil
+		}
+		return []byte(time.Now().UTC().Format(time.RFC3339)), nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed deferring account priming for %s, they won't be primed", userId)
+		return false
+	}
+	return true
+}
+
+// retryPriming primes users whose priming was deferred, giving up on ones that have been pending too long.
+func (p *Plugin) retryPriming() {
+	pending := map[string]time.Time{}
+	p.store.ForEach(primingPendingBucket, func(key string, value []byte) error {
+		// Unreadable markers parse as the zero time and are given up on
+		since, _ := time.Parse(time.RFC3339, string(value))
+		pending[key] = since
+		return nil
+	})
+
+	for userId, since := range pending {
+		if time.Since(since) > primingRetryFor {
+			log.Warnf("cointip: giving up on account priming for %s - pending since %s", userId, since)
+			p.store.Delete(primingPendingBucket, userId)
+			continue
+		}
+		account, err := p.getOrCreateAccount(userId)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed retrying account priming for %s", userId)
+			continue
+		}
+		p.primeAccount(userId, account)
+	}
+}
+
+func (p *Plugin) primingRetryLoop(ctx context.Context) {
+	ticker := time.NewTicker(primingRetryEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.retryPriming()
+		case <-ctx.Done():
+			log.Info("cointip: stopping priming retries")
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cointip
+
+import (
+	"testing"
+	"time"
+)
+
+func withTestPriming() Option {
+	priming := DefaultPriming
+	return WithPriming(&priming)
+}
+
+func TestPrimingDeferredWithoutBot(t *testing.T) {
+	p, fc := newTestPlugin(t, withTestPriming())
+
+	// There's no bot to look the user up with until the first message arrives
+	account, err := p.getOrCreateAccount("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.usd(account.ID); got != 0 {
+		t.Fatalf("primed $%.2f without checking the user", got)
+	}
+	marker, _ := p.store.Get(primingPendingBucket, "A")
+	if marker == nil {
+		t.Fatal("priming wasn't deferred")
+	}
+
+	// Still no bot, so it stays pending with its original time
+	p.retryPriming()
+	again, _ := p.store.Get(primingPendingBucket, "A")
+	if string(again) != string(marker) {
+		t.Fatalf("pending marker changed from %q to %q", marker, again)
+	}
+}
+
+func TestPrimingRetryGivesUp(t *testing.T) {
+	p, _ := newTestPlugin(t, withTestPriming())
+	p.store.Put(primingPendingBucket, "A", []byte(time.Now().Add(-8*day).UTC().Format(time.RFC3339)))
+	p.store.Put(primingPendingBucket, "B", []byte("garbage"))
+
+	p.retryPriming()
+	if p.countBucket(primingPendingBucket) != 0 {
+		t.Fatal("expected stale pending primings to be dropped")
+	}
+	if p.countBucket(accountsBucket) != 1 {
+		t.Fatal("gave up on priming but still created tipjars")
+	}
+}
+
+func TestPrimingRetryForgetsPrimedUsers(t *testing.T) {
+	p, fc := newTestPlugin(t, withTestPriming())
+	addTestUser(t, p, fc, "A", 0)
+	p.store.Put(primedBucket, "A", []byte(`{}`))
+	p.deferPriming("A")
+
+	p.retryPriming()
+	if marker, _ := p.store.Get(primingPendingBucket, "A"); marker != nil {
+		t.Fatal("already primed user is still pending")
+	}
+}
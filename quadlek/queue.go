@@ -0,0 +1,312 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tips from reactions go through a queue persisted in the store so a slow coinbase call doesn't hold up the reaction
+// hook, and a crash doesn't lose tips. Jobs are sharded across workers by sender, and each worker works through its
+// jobs in the order they were queued, so one sender's tips are processed in order. A job is marked in flight before
+// each attempt and removed once it's done. Jobs still in flight on startup may have been sent, so they're dead-lettered
+// for an operator instead of being sent again.
+
+const (
+	tipJobsBucket     = "tip_jobs"
+	tipJobsDeadBucket = "tip_jobs_dead"
+	tipJobSeqKey      = "tip_job_seq"
+
+	tipRetryBackoff    = 2 * time.Second
+	tipRetryMaxBackoff = 5 * time.Minute
+)
+
+type tipJob struct {
+	ID        string           `json:"id"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Channel   string           `json:"channel"`
+	Message   string           `json:"message"`
+	Amount    *cointip.Balance `json:"amount"`
+	Memo      string           `json:"memo"`
+	Reaction  string           `json:"reaction"` // reactionKey of the reaction that made the tip, if any
+	Attempts  int              `json:"attempts"`
+	InFlight  bool             `json:"in_flight"` // Set while a transfer may be under way
+	LastError string           `json:"last_error"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type queue struct {
+	plugin  *Plugin
+	workers []chan struct{} // Wakes a worker up to look for new jobs
+}
+
+func newTipQueue(p *Plugin, workers int) *queue {
+	q := &queue{plugin: p}
+	for i := 0; i < workers; i++ {
+		q.workers = append(q.workers, make(chan struct{}, 1))
+	}
+	return q
+}
+
+// enqueue persists a tip and wakes up its sender's worker.
+func (q *queue) enqueue(t *tipRecord, reaction string) error {
+	seq, err := q.plugin.nextId(tipJobSeqKey)
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(seq)
+
+	job := &tipJob{
+		// Zero padded so the store keeps jobs in the order they were queued
+		ID:        fmt.Sprintf("%020d", n),
+		From:      t.From,
+		To:        t.To,
+		Channel:   t.Channel,
+		Message:   t.Message,
+		Amount:    t.Amount,
+		Memo:      t.Memo,
+		Reaction:  reaction,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err = q.plugin.saveTipJob(tipJobsBucket, job)
+	if err != nil {
+		return err
+	}
+	q.wake(q.shard(job.From))
+	return nil
+}
+
+// shard picks the worker for a sender's jobs.
+func (q *queue) shard(userId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userId))
+	return int(h.Sum32() % uint32(len(q.workers)))
+}
+
+// wake signals a worker without waiting. A worker that's busy picks up the new job when it next looks.
+func (q *queue) wake(worker int) {
+	select {
+	case q.workers[worker] <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the workers. Jobs left over from a previous run are picked up by their first look, apart from ones that
+// were in flight.
+func (q *queue) run(ctx context.Context) {
+	q.recoverInFlight()
+	for i := range q.workers {
+		go q.work(ctx, i)
+		q.wake(i)
+	}
+}
+
+func (q *queue) work(ctx context.Context, worker int) {
+	// Jobs this worker has handled, in case one couldn't be removed from the store
+	handled := map[string]bool{}
+	for {
+		select {
+		case <-q.workers[worker]:
+		case <-ctx.Done():
+			return
+		}
+
+		jobs, err := q.pending(worker)
+		if err != nil {
+			log.WithError(err).Error("cointip: failed loading pending tip jobs")
+			continue
+		}
+
+		seen := map[string]bool{}
+		for _, job := range jobs {
+			seen[job.ID] = true
+			if handled[job.ID] {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			q.process(ctx, job)
+			handled[job.ID] = true
+		}
+		for id := range handled {
+			if !seen[id] {
+				delete(handled, id)
+			}
+		}
+	}
+}
+
+// recoverInFlight dead-letters jobs a previous run was in the middle of.
+func (q *queue) recoverInFlight() {
+	jobs := []*tipJob{}
+	err := q.plugin.store.ForEach(tipJobsBucket, func(key string, value []byte) error {
+		job := &tipJob{}
+		if json.Unmarshal(value, job) == nil && job.InFlight {
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed checking for interrupted tip jobs")
+	}
+	for _, job := range jobs {
+		job.LastError = "interrupted while sending, the transfer may have gone through, check coinbase before retrying"
+		q.plugin.deadLetter(job)
+	}
+}
+
+// pending returns a worker's queued jobs, oldest first.
+func (q *queue) pending(worker int) ([]*tipJob, error) {
+	jobs := []*tipJob{}
+	err := q.plugin.store.ForEach(tipJobsBucket, func(key string, value []byte) error {
+		job := &tipJob{}
+		err := json.Unmarshal(value, job)
+		if err != nil {
+			return err
+		}
+		if q.shard(job.From) == worker {
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// process tries a job until it succeeds, fails permanently or runs out of attempts. Retries block the worker so later
+// tips from the same sender wait their turn.
+func (q *queue) process(ctx context.Context, job *tipJob) {
+	if q.plugin.reactionTipCancelled(job.Reaction) {
+		q.plugin.store.Delete(tipJobsBucket, job.ID)
+		return
+	}
+
+	for {
+		// Persisted before the transfer so a crash doesn't send the tip again on startup
+		job.InFlight = true
+		err := q.plugin.saveTipJob(tipJobsBucket, job)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed marking tip job %s in flight", job.ID)
+			select {
+			case <-time.After(backoff(job.Attempts + 1)):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		record := &tipRecord{From: job.From, To: job.To, Channel: job.Channel, Message: job.Message, Amount: job.Amount, Memo: job.Memo}
+		err = q.plugin.tip(record)
+		if err == nil {
+			err = q.plugin.store.Delete(tipJobsBucket, job.ID)
+			if err != nil {
+				log.WithError(err).Errorf("cointip: failed removing finished tip job %s, it will be dead-lettered on restart", job.ID)
+			}
+			q.plugin.reactionTipSent(job.Reaction, record)
+			return
+		}
+		if err == errSelfTip {
+			log.Infof("cointip: skipping tip - user is tipping themselves")
+			q.plugin.store.Delete(tipJobsBucket, job.ID)
+			q.plugin.reactionTipFailed(job.Reaction)
+			return
+		}
+		if isLimitError(err) {
+			log.Infof("cointip: refused tip job %s from:%s to:%s: %s", job.ID, job.From, job.To, err)
+			q.plugin.store.Delete(tipJobsBucket, job.ID)
+			q.plugin.notifyTipFailed(record, err.Error())
+			q.plugin.reactionTipFailed(job.Reaction)
+			return
+		}
+
+		job.Attempts++
+		job.LastError = err.Error()
+		job.InFlight = mayHaveTransferred(err)
+		log.WithError(err).Errorf("cointip: tip job %s failed (attempt %d/%d)", job.ID, job.Attempts, q.plugin.config.TipMaxAttempts)
+
+		if !retryable(err) || job.Attempts >= q.plugin.config.TipMaxAttempts {
+			if job.InFlight {
+				job.LastError += " (the transfer may have gone through, check coinbase before retrying)"
+			}
+			q.plugin.deadLetter(job)
+			return
+		}
+
+		err = q.plugin.saveTipJob(tipJobsBucket, job)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed saving tip job %s", job.ID)
+		}
+
+		select {
+		case <-time.After(backoff(job.Attempts)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryable returns false for errors retrying won't fix, like insufficient funds, and for transfers that may have gone
+// through. Transfers aren't idempotent, so a transfer is only retried when coinbase rate limited it and so never
+// started it.
+func retryable(err error) bool {
+	apiErr := &cointip.Error{}
+	isAPIErr := errors.As(err, &apiErr)
+
+	var transferErr *transferError
+	if errors.As(err, &transferErr) {
+		return isAPIErr && apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	if isAPIErr {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// mayHaveTransferred returns true if a transfer failed without coinbase saying it was refused.
+func mayHaveTransferred(err error) bool {
+	var transferErr *transferError
+	if !errors.As(err, &transferErr) {
+		return false
+	}
+	apiErr := &cointip.Error{}
+	return !errors.As(err, &apiErr) || apiErr.StatusCode >= 500
+}
+
+func backoff(attempts int) time.Duration {
+	d := tipRetryBackoff << uint(attempts-1)
+	if d > tipRetryMaxBackoff || d <= 0 {
+		return tipRetryMaxBackoff
+	}
+	return d
+}
+
+// deadLetter moves a job that won't succeed out of the queue for an operator to look at.
+func (p *Plugin) deadLetter(job *tipJob) {
+	log.Errorf("cointip: giving up on tip job %s from:%s to:%s %s: %s", job.ID, job.From, job.To, amountString(job.Amount), job.LastError)
+	p.notifyTipFailed(&tipRecord{From: job.From, To: job.To, Channel: job.Channel, Message: job.Message, Amount: job.Amount}, job.LastError)
+	p.reactionTipFailed(job.Reaction)
+	err := p.saveTipJob(tipJobsDeadBucket, job)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed dead-lettering tip job %s", job.ID)
+		return
+	}
+	p.store.Delete(tipJobsBucket, job.ID)
+}
+
+func (p *Plugin) saveTipJob(bucket string, job *tipJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(bucket, job.ID, data)
+}
@@ -0,0 +1,173 @@
+package cointip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestRetryable(t *testing.T) {
+	apiErr := func(status int) error {
+		return &cointip.Error{StatusCode: status, Errors: []cointip.APIError{{ID: "x"}}}
+	}
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+
+	tests := []struct {
+		name      string
+		err       error
+		retry     bool
+		mayHaveTx bool
+	}{
+		{"account lookup timeout", timeout, true, false},
+		{"account lookup 503", apiErr(http.StatusServiceUnavailable), true, false},
+		{"account lookup 404", apiErr(http.StatusNotFound), false, false},
+		{"transfer rate limited", &transferError{apiErr(http.StatusTooManyRequests)}, true, false},
+		{"transfer insufficient funds", &transferError{apiErr(http.StatusBadRequest)}, false, false},
+		{"transfer 500", &transferError{apiErr(http.StatusInternalServerError)}, false, true},
+		{"transfer timeout", &transferError{timeout}, false, true},
+		{"transfer connection reset", &transferError{errors.New("connection reset by peer")}, false, true},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.retry {
+			t.Errorf("%s: retryable got %t, want %t", test.name, got, test.retry)
+		}
+		if got := mayHaveTransferred(test.err); got != test.mayHaveTx {
+			t.Errorf("%s: mayHaveTransferred got %t, want %t", test.name, got, test.mayHaveTx)
+		}
+	}
+}
+
+// runQueue starts the tip workers and waits for the queue to drain.
+func runQueue(t *testing.T, p *Plugin) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.tipQueue.run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.countBucket(tipJobsBucket) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tip jobs still queued", p.countBucket(tipJobsBucket))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueEnqueueDoesntBlock(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipWorkers(1, 1))
+	a := addTestUser(t, p, fc, "A", 10)
+	b := addTestUser(t, p, fc, "B", 0)
+
+	// Far more than a worker would have buffered, with nothing running yet
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 500; i++ {
+			if err := p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(0.01)}, ""); err != nil {
+				t.Error(err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue blocked")
+	}
+
+	runQueue(t, p)
+	if got := fc.usd(b.ID); got != 5 {
+		t.Fatalf("B got $%.2f, want $5.00", got)
+	}
+	if got := fc.usd(a.ID); got != 5 {
+		t.Fatalf("A has $%.2f, want $5.00", got)
+	}
+}
+
+func TestQueueJobIdsAreOrdered(t *testing.T) {
+	p, _ := newTestPlugin(t, WithTipWorkers(1, 1))
+	for i := 0; i < 20; i++ {
+		p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(0.01)}, "")
+	}
+
+	jobs, err := p.tipQueue.pending(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 20 {
+		t.Fatalf("got %d jobs, want 20", len(jobs))
+	}
+	for i := 1; i < len(jobs); i++ {
+		if jobs[i].ID <= jobs[i-1].ID {
+			t.Fatalf("job %s queued after %s", jobs[i].ID, jobs[i-1].ID)
+		}
+	}
+}
+
+func TestQueueDoesntRetryAmbiguousTransfers(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipWorkers(1, 5))
+	addTestUser(t, p, fc, "A", 10)
+	addTestUser(t, p, fc, "B", 0)
+
+	attempts := 0
+	fc.transferErr = func(from, to string, amount *cointip.Balance) error {
+		attempts++
+		return &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	}
+
+	p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(1)}, "")
+	runQueue(t, p)
+
+	if attempts != 1 {
+		t.Fatalf("transfer tried %d times, want 1", attempts)
+	}
+	if n := p.countBucket(tipJobsDeadBucket); n != 1 {
+		t.Fatalf("got %d dead-lettered jobs, want 1", n)
+	}
+}
+
+func TestQueueDeadLettersInFlightJobsOnStartup(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipWorkers(1, 5))
+	addTestUser(t, p, fc, "A", 10)
+	addTestUser(t, p, fc, "B", 0)
+
+	// A previous run crashed during the first transfer, before it could remove the job
+	p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(1)}, "")
+	p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(2)}, "")
+	jobs, _ := p.tipQueue.pending(0)
+	jobs[0].InFlight = true
+	p.saveTipJob(tipJobsBucket, jobs[0])
+
+	runQueue(t, p)
+
+	if n := fc.transferCount(); n != 1 {
+		t.Fatalf("made %d transfers, want only the job that wasn't in flight", n)
+	}
+	if n := p.countBucket(tipJobsDeadBucket); n != 1 {
+		t.Fatalf("got %d dead-lettered jobs, want 1", n)
+	}
+}
+
+func TestQueueDoesntRetryLedgerInsufficientFunds(t *testing.T) {
+	p, fc := newTestPlugin(t, WithLedger(0), WithTipWorkers(1, 5))
+	addTestUser(t, p, fc, "A", 0.50)
+	addTestUser(t, p, fc, "B", 0)
+
+	p.tipQueue.enqueue(&tipRecord{From: "A", To: "B", Amount: usd(1)}, "")
+	start := time.Now()
+	runQueue(t, p)
+
+	if time.Since(start) > tipRetryBackoff {
+		t.Fatalf("refused tip was retried")
+	}
+	if n := p.countBucket(tipJobsDeadBucket); n != 0 {
+		t.Fatalf("got %d dead-lettered jobs, want the refusal dropped", n)
+	}
+	if pos, _ := p.loadPositions(); len(pos) != 0 {
+		t.Fatalf("refused tip changed positions: %v", pos)
+	}
+}
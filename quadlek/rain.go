@@ -0,0 +1,308 @@
+package cointip
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rain needs to know who's been talking where, so a message hook records when each user last posted in each channel.
+const activityBucket = "activity"
+
+const (
+	defaultRainActive = 24 * time.Hour
+	maxRainActive     = 30 * 24 * time.Hour
+
+	// Posting every message to the store is wasteful, a user's activity is only written this often.
+	activityWriteEvery = 5 * time.Minute
+)
+
+var channelRegexp = regexp.MustCompile(`^<#([A-Z0-9]+)(?:\|[^>]*)?>$`)
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "rain",
+		Usage: "<amount> [#channel] [--active 24h]",
+		Help:  "Split an amount between everyone who posted in a channel you're part of recently",
+		Run:   (*Plugin).rainCommand,
+	})
+}
+
+func activityKey(channel, userId string) string {
+	return channel + "/" + userId
+}
+
+// recordActivity remembers that a user posted in a channel.
+func (p *Plugin) recordActivity(channel, userId string, at time.Time) {
+	key := activityKey(channel, userId)
+
+	p.activityLock.Lock()
+	last := p.activity[key]
+	if at.Sub(last) < activityWriteEvery {
+		p.activityLock.Unlock()
+		return
+	}
+	p.activity[key] = at
+	p.activityLock.Unlock()
+
+	err := p.store.Put(activityBucket, key, []byte(at.UTC().Format(time.RFC3339)))
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording activity for %s", key)
+	}
+}
+
+// activeUsers returns the users who posted in a channel since the given time.
+func (p *Plugin) activeUsers(channel string, since time.Time) ([]string, error) {
+	users := []string{}
+	prefix := channel + "/"
+	err := p.store.ForEach(activityBucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		at, err := time.Parse(time.RFC3339, string(value))
+		if err == nil && !at.Before(since) {
+			users = append(users, strings.TrimPrefix(key, prefix))
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (p *Plugin) activityHook(ctx context.Context, hookChannel <-chan *quadlek.HookMsg) {
+	for {
+		select {
+		case hm := <-hookChannel:
+			p.setBot(hm.Bot)
+			// Edits, joins and the like aren't activity
+			if hm.Msg.User == "" || hm.Msg.BotID != "" || hm.Msg.SubType != "" {
+				continue
+			}
+			p.recordActivity(hm.Msg.Channel, hm.Msg.User, time.Now())
+
+		case <-ctx.Done():
+			log.Info("cointip: stopping activity hook")
+			return
+		}
+	}
+}
+
+// parseActive parses a duration like 30m, 24h or 7d.
+func parseActive(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		days, convErr := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d, err = time.Duration(days)*24*time.Hour, convErr
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 || d > maxRainActive {
+		return 0, fmt.Errorf("--active takes a duration like 30m, 24h or 7d, up to %dd, got %q", int(maxRainActive.Hours()/24), s)
+	}
+	return d, nil
+}
+
+// rainChannel resolves a #channel argument to a channel id.
+func rainChannel(bot *quadlek.Bot, t *token) (string, error) {
+	if m := channelRegexp.FindStringSubmatch(t.Text); m != nil {
+		return m[1], nil
+	}
+	if strings.HasPrefix(t.Text, "#") && len(t.Text) > 1 {
+		channel, err := bot.GetChannelId(t.Text[1:])
+		if err != nil {
+			return "", fmt.Errorf("unknown channel %s", t.Text)
+		}
+		return channel, nil
+	}
+	return "", fmt.Errorf("expected a #channel, got %q", t.Text)
+}
+
+// rainEligible leaves out bots and deactivated users.
+func (p *Plugin) rainEligible(bot *quadlek.Bot, userId string) bool {
+	user, err := bot.GetUser(userId)
+	if err != nil {
+		log.WithError(err).Warnf("cointip: leaving %s out of rain - failed looking up slack user", userId)
+		return false
+	}
+	return !user.IsBot && !user.Deleted
+}
+
+// checkRainChannel refuses rain on a channel other than the one the command was run in unless the sender posted there
+// since the given time, so nobody can rain on a channel they aren't part of.
+func (p *Plugin) checkRainChannel(from, here, channel string, since time.Time) error {
+	if channel == here {
+		return nil
+	}
+	posted, err := p.activeUsers(channel, since)
+	if err != nil {
+		return err
+	}
+	for _, userId := range posted {
+		if userId == from {
+			return nil
+		}
+	}
+	return fmt.Errorf("you can only make it rain in <#%s> if you've posted there recently", channel)
+}
+
+// /cointip rain <amount> [#channel] [--active 24h]
+func (p *Plugin) rainCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	from := cmdMsg.Command.UserId
+	if len(args) < 1 {
+		sayUsage(cmdMsg, subcommands["rain"])
+		return
+	}
+
+	total, err := args[0].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	channel := cmdMsg.Command.ChannelId
+	active := defaultRainActive
+	for i := 1; i < len(args); i++ {
+		if args[i].Text == "--active" {
+			if i+1 >= len(args) {
+				sayUsage(cmdMsg, subcommands["rain"])
+				return
+			}
+			active, err = parseActive(args[i+1].Text)
+			i++
+		} else {
+			channel, err = rainChannel(cmdMsg.Bot, args[i])
+		}
+		if err != nil {
+			say(cmdMsg, err.Error(), false)
+			return
+		}
+	}
+
+	// Split in whatever is actually transferred, so shares are exact
+	total, err = p.transferAmount(total)
+	if err != nil {
+		log.WithError(err).Error("cointip: rain failed")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	err = p.checkRainChannel(from, cmdMsg.Command.ChannelId, channel, time.Now().Add(-active))
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	posted, err := p.activeUsers(channel, time.Now().Add(-active))
+	if err != nil {
+		log.WithError(err).Error("cointip: rain failed - failed loading activity")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	recipients := []string{}
+	for _, userId := range posted {
+		if userId != from && !p.blockedPair(from, userId) && p.rainEligible(cmdMsg.Bot, userId) {
+			recipients = append(recipients, userId)
+		}
+	}
+	sort.Strings(recipients)
+	if len(recipients) == 0 {
+		say(cmdMsg, fmt.Sprintf("nobody else has posted in <#%s> in the last %s", channel, active), false)
+		return
+	}
+
+	// Whatever doesn't split evenly stays with the sender
+	units := toUnits(total) / int64(len(recipients))
+	if units <= 0 {
+		say(cmdMsg, fmt.Sprintf("%s is too little to split %d ways", amountString(total), len(recipients)), false)
+		return
+	}
+	share := fromUnits(total.Currency, units)
+	rained := fromUnits(total.Currency, units*int64(len(recipients)))
+
+	// The rain is checked against the sender's limits as a whole, and each share against the per recipient limits
+	err = p.checkFrozen(from)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	account, err := p.getOrCreateAccount(from)
+	if err != nil {
+		log.WithError(err).Error("cointip: rain failed - failed fetching coinbase account")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	whole := &tipRecord{From: from, Channel: channel, Amount: rained, Memo: "cointip rain", Time: time.Now().UTC()}
+	reserved, err := p.reserveTipSpend(whole, account)
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: rain failed - failed checking limits")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	shareSpent := 0.0
+	if reserved != nil {
+		shareSpent = reserved.Amount / float64(len(recipients))
+	}
+
+	sent := []string{}
+	failed := []string{}
+	sentSpends := 0 // Shares that were sent or may have been
+	for _, to := range recipients {
+		shareReserved, err := p.reserveRecipientSpend(from, to, shareSpent)
+		if isLimitError(err) {
+			failed = append(failed, fmt.Sprintf("<@%s> (%s)", to, err))
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Errorf("cointip: rain share to %s failed - failed checking limits", to)
+			failed = append(failed, fmt.Sprintf("<@%s> (%s)", to, err))
+			continue
+		}
+
+		record := &tipRecord{From: from, To: to, Channel: channel, Amount: share, Memo: "cointip rain"}
+		err = p.sendTip(record, false)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: rain share to %s failed", to)
+			if !mayHaveTransferred(err) {
+				p.releaseSpend(from, shareReserved)
+				failed = append(failed, fmt.Sprintf("<@%s> (%s)", to, err))
+				continue
+			}
+			failed = append(failed, fmt.Sprintf("<@%s> (%s, it may have gone through)", to, err))
+			sentSpends++
+			continue
+		}
+		sentSpends++
+		sent = append(sent, fmt.Sprintf("<@%s>", to))
+		p.dm(to, fmt.Sprintf("<@%s> made it rain in <#%s>, you got %s", from, channel, p.displayAmount(to, share)))
+	}
+	whole.Amount = fromUnits(total.Currency, units*int64(len(sent)))
+
+	// Only what was sent counts toward the sender's totals
+	if sentSpends == 0 {
+		p.releaseSpend(from, reserved)
+	} else {
+		p.adjustSpend(from, reserved, shareSpent*float64(sentSpends))
+	}
+
+	if len(sent) == 0 {
+		say(cmdMsg, fmt.Sprintf("rain failed for everyone:\n%s", strings.Join(failed, "\n")), false)
+		return
+	}
+	msg := fmt.Sprintf("<@%s> made it rain %s on %s (%s each)", from, amountString(whole.Amount), strings.Join(sent, " "), amountString(share))
+	if len(failed) > 0 {
+		msg += fmt.Sprintf("\ncouldn't send to:\n%s", strings.Join(failed, "\n"))
+	}
+	say(cmdMsg, msg, true)
+}
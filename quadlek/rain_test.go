@@ -0,0 +1,33 @@
+package cointip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckRainChannel(t *testing.T) {
+	p, _ := newTestPlugin(t)
+	now := time.Now()
+	p.recordActivity("C1", "A", now.Add(-time.Hour))
+	p.recordActivity("C2", "A", now.Add(-48*time.Hour))
+	p.recordActivity("C2", "B", now.Add(-time.Hour))
+
+	since := now.Add(-24 * time.Hour)
+	tests := []struct {
+		channel string
+		allowed bool
+	}{
+		// The channel the command was run in is always fine
+		{"C0", true},
+		{"C1", true},
+		// Posted there, but not recently
+		{"C2", false},
+		{"C3", false},
+	}
+	for _, test := range tests {
+		err := p.checkRainChannel("A", "C0", test.channel, since)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: got %v, want allowed %t", test.channel, err, test.allowed)
+		}
+	}
+}
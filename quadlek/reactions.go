@@ -0,0 +1,96 @@
+package cointip
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/morgabra/cointip"
+)
+
+// ReactionPattern tips n * Unit of Currency for reactions matching Pattern, where Pattern contains a single <n>
+// placeholder. For example {"cointip_<n>", "USD", 0.01} tips cents and {"tip_<n>usd", "USD", 1} tips dollars.
+type ReactionPattern struct {
+	Pattern  string
+	Currency string
+	Unit     float64
+	Max      float64 // Largest amount a single reaction may tip in Currency, not units. 0 for no limit
+
+	re   *regexp.Regexp
+	maxN int // Largest n allowed by Max
+}
+
+// DefaultReactions are the fixed reactions used when none are configured.
+var DefaultReactions = map[string]cointip.Balance{
+	"cointip_1":  {Currency: cointip.CurrencyUSD, Amount: .01},
+	"cointip_2":  {Currency: cointip.CurrencyUSD, Amount: .02},
+	"cointip_5":  {Currency: cointip.CurrencyUSD, Amount: .05},
+	"cointip_10": {Currency: cointip.CurrencyUSD, Amount: .10},
+	"cointip_25": {Currency: cointip.CurrencyUSD, Amount: .25},
+}
+
+// DefaultReactionPatterns tip in satoshis, e.g. :cointip_1000sat:.
+var DefaultReactionPatterns = []ReactionPattern{
+	{Pattern: "cointip_<n>sat", Currency: cointip.CurrencyBTC, Unit: satoshi, Max: 100000 * satoshi},
+}
+
+func (p *ReactionPattern) compile() error {
+	parts := strings.Split(p.Pattern, "<n>")
+	if len(parts) != 2 {
+		return fmt.Errorf("reaction pattern %q must contain exactly one <n>", p.Pattern)
+	}
+	if !supportedCurrencies[p.Currency] {
+		return fmt.Errorf("reaction pattern %q has unsupported currency %q", p.Pattern, p.Currency)
+	}
+	if p.Unit <= 0 {
+		return fmt.Errorf("reaction pattern %q must have a positive unit", p.Pattern)
+	}
+
+	re, err := regexp.Compile("^" + regexp.QuoteMeta(parts[0]) + `(\d+)` + regexp.QuoteMeta(parts[1]) + "$")
+	if err != nil {
+		return err
+	}
+	p.re = re
+
+	// Compare whole units so float error in Max can't let one unit too many through, or refuse the last one
+	p.maxN = 0
+	if p.Max > 0 {
+		p.maxN = int(math.Floor(p.Max/p.Unit + 1e-9))
+		if p.maxN < 1 {
+			return fmt.Errorf("reaction pattern %q has a max smaller than its unit", p.Pattern)
+		}
+	}
+	return nil
+}
+
+func (p *ReactionPattern) match(reaction string) *cointip.Balance {
+	m := p.re.FindStringSubmatch(reaction)
+	if m == nil {
+		return nil
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	if p.maxN > 0 && n > p.maxN {
+		return nil
+	}
+	return &cointip.Balance{Currency: p.Currency, Amount: float64(n) * p.Unit}
+}
+
+// reactionAmount returns how much a reaction tips, or nil if it isn't a tip reaction. Fixed reactions win over
+// patterns.
+func (p *Plugin) reactionAmount(reaction string) *cointip.Balance {
+	if amount, ok := p.config.Reactions[reaction]; ok {
+		return &cointip.Balance{Currency: amount.Currency, Amount: amount.Amount}
+	}
+	for _, pattern := range p.reactionPatterns {
+		if amount := pattern.match(reaction); amount != nil {
+			return amount
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package cointip
+
+import (
+	"math"
+	"testing"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestReactionPatterns(t *testing.T) {
+	patterns := append([]ReactionPattern{
+		{Pattern: "cointip_<n>", Currency: cointip.CurrencyUSD, Unit: 0.01, Max: 5},
+		{Pattern: "tip_<n>usd", Currency: cointip.CurrencyUSD, Unit: 1},
+	}, DefaultReactionPatterns...)
+	p, _ := newTestPlugin(t, WithReactionPatterns(patterns...))
+
+	tests := []struct {
+		reaction string
+		currency string
+		amount   float64 // 0 if the reaction doesn't tip
+	}{
+		{"cointip_1sat", cointip.CurrencyBTC, 0.00000001},
+		{"cointip_100000sat", cointip.CurrencyBTC, 0.001},
+		{"cointip_100001sat", "", 0},
+		{"cointip_0sat", "", 0},
+		{"cointip_25", cointip.CurrencyUSD, 0.25},
+		{"cointip_500", cointip.CurrencyUSD, 5},
+		{"cointip_501", "", 0},
+		{"tip_1000usd", cointip.CurrencyUSD, 1000},
+		{"cointip_", "", 0},
+		{"cointip_-1", "", 0},
+		{"xcointip_5", "", 0},
+		{"thumbsup", "", 0},
+	}
+
+	for _, test := range tests {
+		amount := p.reactionAmount(test.reaction)
+		if test.amount == 0 {
+			if amount != nil {
+				t.Errorf("%s: got %s, want no tip", test.reaction, amountString(amount))
+			}
+			continue
+		}
+		if amount == nil {
+			t.Errorf("%s: got no tip, want %s %f", test.reaction, test.currency, test.amount)
+			continue
+		}
+		if amount.Currency != test.currency || math.Abs(amount.Amount-test.amount) > 1e-12 {
+			t.Errorf("%s: got %s %f, want %s %f", test.reaction, amount.Currency, amount.Amount, test.currency, test.amount)
+		}
+	}
+}
+
+func TestFixedReactionsWinOverPatterns(t *testing.T) {
+	p, _ := newTestPlugin(t, WithReactionPatterns(ReactionPattern{Pattern: "cointip_<n>", Currency: cointip.CurrencyUSD, Unit: 1}))
+
+	amount := p.reactionAmount("cointip_5")
+	if amount == nil || amount.Amount != 0.05 {
+		t.Fatalf("got %v, want the fixed USD:0.05", amount)
+	}
+}
+
+func TestReactionPatternCompile(t *testing.T) {
+	tests := []struct {
+		pattern ReactionPattern
+		valid   bool
+	}{
+		{ReactionPattern{Pattern: "tip_<n>", Currency: cointip.CurrencyUSD, Unit: 1}, true},
+		{ReactionPattern{Pattern: "tip", Currency: cointip.CurrencyUSD, Unit: 1}, false},
+		{ReactionPattern{Pattern: "tip_<n>_<n>", Currency: cointip.CurrencyUSD, Unit: 1}, false},
+		{ReactionPattern{Pattern: "tip_<n>", Currency: "XYZ", Unit: 1}, false},
+		{ReactionPattern{Pattern: "tip_<n>", Currency: cointip.CurrencyUSD}, false},
+		{ReactionPattern{Pattern: "tip_<n>", Currency: cointip.CurrencyUSD, Unit: 1, Max: 0.5}, false},
+	}
+	for _, test := range tests {
+		err := test.pattern.compile()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v", test.pattern, err)
+		}
+	}
+}
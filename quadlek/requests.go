@@ -0,0 +1,214 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Money requests are kept in the store until they're paid, declined or expire.
+const (
+	moneyRequestsBucket = "money_requests"
+	moneyRequestSeqKey  = "money_request_seq"
+
+	moneyRequestTTL = 7 * 24 * time.Hour
+)
+
+// moneyRequest is a request from one user for another user to pay them from their tipjar.
+type moneyRequest struct {
+	ID        string           `json:"id"`
+	From      string           `json:"from"` // User asking to be paid
+	To        string           `json:"to"`   // User being asked to pay
+	Amount    *cointip.Balance `json:"amount"`
+	Memo      string           `json:"memo"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func (r *moneyRequest) expired() bool {
+	return time.Since(r.CreatedAt) > moneyRequestTTL
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "request",
+		Usage: "@user <amount> [memo]",
+		Help:  "Ask someone to pay you from their tipjar",
+		Run:   (*Plugin).requestCommand,
+	})
+	registerSubcommand(&subcommand{
+		Name:  "pay",
+		Usage: "<request id>",
+		Help:  "Pay a request someone made of you",
+		Run:   (*Plugin).payCommand,
+	})
+	registerSubcommand(&subcommand{
+		Name:  "decline",
+		Usage: "<request id>",
+		Help:  "Decline a request someone made of you",
+		Run:   (*Plugin).declineCommand,
+	})
+}
+
+// /cointip request @user <amount> [memo...]
+func (p *Plugin) requestCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) < 2 {
+		sayUsage(cmdMsg, subcommands["request"])
+		return
+	}
+
+	to, err := args[0].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if to == cmdMsg.Command.UserId {
+		say(cmdMsg, "you can't request money from yourself", false)
+		return
+	}
+
+	amount, err := args[1].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	p.pruneRequests()
+
+	id, err := p.nextId(moneyRequestSeqKey)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed allocating request id")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	req := &moneyRequest{
+		ID:        id,
+		From:      cmdMsg.Command.UserId,
+		To:        to,
+		Amount:    amount,
+		Memo:      joinTokens(args[2:]),
+		CreatedAt: time.Now().UTC(),
+	}
+	err = p.saveRequest(req)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed saving request")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: money request %s from:%s to:%s %s", req.ID, req.From, req.To, amountString(amount))
+
+	msg := fmt.Sprintf("<@%s> requested %s from <@%s>", req.From, amountString(amount), req.To)
+	if req.Memo != "" {
+		msg += fmt.Sprintf(" %s", req.Memo)
+	}
+	msg += fmt.Sprintf("\n<@%s>: `/cointip pay %s` to pay from your tipjar, or `/cointip decline %s`", req.To, req.ID, req.ID)
+	say(cmdMsg, msg, true)
+}
+
+func (p *Plugin) saveRequest(req *moneyRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(moneyRequestsBucket, req.ID, data)
+}
+
+// takeRequest removes and returns a pending request addressed to userId.
+func (p *Plugin) takeRequest(id, userId string) (*moneyRequest, error) {
+	var req *moneyRequest
+	err := p.store.Update(moneyRequestsBucket, id, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, nil
+		}
+		r := &moneyRequest{}
+		err := json.Unmarshal(value, r)
+		if err != nil {
+			return nil, err
+		}
+		if r.To != userId {
+			return value, nil
+		}
+		if !r.expired() {
+			req = r
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		return nil, fmt.Errorf("no pending request %s for you", id)
+	}
+	return req, nil
+}
+
+// pruneRequests forgets requests nobody answered in time.
+func (p *Plugin) pruneRequests() {
+	expired := []string{}
+	p.store.ForEach(moneyRequestsBucket, func(key string, value []byte) error {
+		req := &moneyRequest{}
+		if json.Unmarshal(value, req) == nil && req.expired() {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		p.store.Delete(moneyRequestsBucket, key)
+	}
+}
+
+// /cointip pay <request id>
+func (p *Plugin) payCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, subcommands["pay"])
+		return
+	}
+
+	req, err := p.takeRequest(args[0].Text, cmdMsg.Command.UserId)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	record := &tipRecord{From: req.To, To: req.From, Channel: cmdMsg.Command.ChannelId, Amount: req.Amount, Memo: req.Memo}
+	err = p.tip(record)
+	if err != nil {
+		// Leave the request open so it can be paid later
+		saveErr := p.saveRequest(req)
+		if saveErr != nil {
+			log.WithError(saveErr).Errorf("cointip: failed reopening request %s", req.ID)
+		}
+	}
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: request payment failed")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: paid money request %s id: %s", req.ID, record.ID)
+	say(cmdMsg, fmt.Sprintf("<@%s> paid <@%s> %s", req.To, req.From, amountString(req.Amount)), true)
+}
+
+// /cointip decline <request id>
+func (p *Plugin) declineCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, subcommands["decline"])
+		return
+	}
+
+	req, err := p.takeRequest(args[0].Text, cmdMsg.Command.UserId)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	say(cmdMsg, fmt.Sprintf("<@%s> declined <@%s>'s request for %s", req.To, req.From, amountString(req.Amount)), true)
+}
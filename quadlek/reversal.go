@@ -0,0 +1,309 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// With reversal enabled every reaction tip is tracked, and removing the reaction within the grace window reverses the
+// tip with a compensating tip back to the sender. In delayed-commit mode tips aren't sent until the grace window has
+// passed, so removing the reaction just cancels them.
+
+const (
+	reactionTipsBucket = "reaction_tips"
+	delayedTipsBucket  = "tip_delayed"
+)
+
+type reactionTip struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Channel    string           `json:"channel"`
+	Message    string           `json:"message"`
+	Amount     *cointip.Balance `json:"amount"`
+	CreatedAt  time.Time        `json:"created_at"`
+	TipID      string           `json:"tip_id"` // Set once the tip is sent
+	RemovedAt  time.Time        `json:"removed_at"`
+	Reversed   bool             `json:"reversed"`
+	ReversalID string           `json:"reversal_id"`
+}
+
+// reactionKey identifies one user's reaction on one message.
+func reactionKey(user, channel, timestamp, reaction string) string {
+	return fmt.Sprintf("%s|%s|%s|%s", user, channel, timestamp, reaction)
+}
+
+func (p *Plugin) getReactionTip(key string) (*reactionTip, error) {
+	data, err := p.store.Get(reactionTipsBucket, key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	rt := &reactionTip{}
+	err = json.Unmarshal(data, rt)
+	return rt, err
+}
+
+// updateReactionTip atomically modifies a tracked tip. fn isn't called for untracked keys, and returning false leaves
+// the tip unchanged.
+func (p *Plugin) updateReactionTip(key string, fn func(rt *reactionTip) bool) (*reactionTip, error) {
+	var updated *reactionTip
+	err := p.store.Update(reactionTipsBucket, key, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, nil
+		}
+		rt := &reactionTip{}
+		err := json.Unmarshal(value, rt)
+		if err != nil {
+			return nil, err
+		}
+		if !fn(rt) {
+			return value, nil
+		}
+		updated = rt
+		return json.Marshal(rt)
+	})
+	return updated, err
+}
+
+// submitReactionTip tips for a reaction: delayed, queued or inline depending on configuration.
+func (p *Plugin) submitReactionTip(key string, t *tipRecord) {
+	if p.config.ReversalGrace > 0 {
+		data, err := json.Marshal(&reactionTip{From: t.From, To: t.To, Channel: t.Channel, Message: t.Message, Amount: t.Amount, CreatedAt: time.Now().UTC()})
+		if err == nil {
+			err = p.store.Put(reactionTipsBucket, key, data)
+		}
+		if err != nil {
+			log.WithError(err).Error("cointip: failed tracking reaction tip, it can't be reversed")
+		}
+
+		if p.config.ReversalDelayedCommit {
+			if err == nil {
+				err = p.store.Put(delayedTipsBucket, key, data)
+			}
+			if err != nil {
+				log.WithError(err).Error("cointip: tip failed - failed delaying tip")
+			}
+			return
+		}
+	}
+
+	p.commitReactionTip(key, t)
+}
+
+func (p *Plugin) commitReactionTip(key string, t *tipRecord) {
+	if p.tipQueue != nil {
+		err := p.tipQueue.enqueue(t, key)
+		if err != nil {
+			log.WithError(err).Error("cointip: tip failed - failed queueing tip")
+			p.reactionTipFailed(key)
+		}
+		return
+	}
+
+	if p.reactionTipCancelled(key) {
+		return
+	}
+	err := p.tip(t)
+	if err == errSelfTip {
+		log.Infof("cointip: skipping tip - user is tipping themselves")
+		p.reactionTipFailed(key)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: tip failed")
+		p.notifyTipFailed(t, err.Error())
+		p.reactionTipFailed(key)
+		return
+	}
+	p.reactionTipSent(key, t)
+}
+
+// reactionTipCancelled returns true if the reaction was removed before its tip was sent, forgetting the tip.
+func (p *Plugin) reactionTipCancelled(key string) bool {
+	if p.config.ReversalGrace == 0 || key == "" {
+		return false
+	}
+	rt, err := p.getReactionTip(key)
+	if err != nil || rt == nil || rt.RemovedAt.IsZero() || rt.TipID != "" {
+		return false
+	}
+	log.Infof("cointip: cancelled tip for removed reaction %s", key)
+	p.store.Delete(reactionTipsBucket, key)
+	return true
+}
+
+// reactionTipFailed forgets a reaction tip that won't be sent, there's nothing to reverse.
+func (p *Plugin) reactionTipFailed(key string) {
+	if p.config.ReversalGrace == 0 || key == "" {
+		return
+	}
+	p.store.Delete(reactionTipsBucket, key)
+}
+
+// reactionTipSent records the tip made for a reaction, reversing it straight away if the reaction was removed while
+// the tip was in flight.
+func (p *Plugin) reactionTipSent(key string, record *tipRecord) {
+	if p.config.ReversalGrace == 0 || key == "" {
+		return
+	}
+	rt, err := p.updateReactionTip(key, func(rt *reactionTip) bool {
+		rt.TipID = record.ID
+		return true
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed tracking reaction tip %s", key)
+		return
+	}
+	if rt != nil && !rt.RemovedAt.IsZero() {
+		p.reverseReactionTip(key)
+	}
+}
+
+// ReactionRemoved cancels or reverses the tip for a reaction that was removed within the grace window. Quadlek only
+// delivers added reactions to reaction hooks, so the host bot calls this from its own reaction_removed handling.
+func (p *Plugin) ReactionRemoved(user, channel, timestamp, reaction string) {
+	if p.config.ReversalGrace == 0 {
+		return
+	}
+	key := reactionKey(user, channel, timestamp, reaction)
+
+	// A delayed tip that hasn't been committed is simply dropped
+	cancelled := false
+	err := p.store.Update(delayedTipsBucket, key, func(value []byte) ([]byte, error) {
+		cancelled = value != nil
+		return nil, nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed cancelling delayed tip %s", key)
+	}
+	if cancelled {
+		log.Infof("cointip: cancelled delayed tip for removed reaction %s", key)
+		p.store.Delete(reactionTipsBucket, key)
+		return
+	}
+
+	rt, err := p.updateReactionTip(key, func(rt *reactionTip) bool {
+		if time.Since(rt.CreatedAt) > p.config.ReversalGrace || !rt.RemovedAt.IsZero() {
+			return false
+		}
+		rt.RemovedAt = time.Now().UTC()
+		return true
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed tracking removed reaction %s", key)
+		return
+	}
+	if rt == nil {
+		log.Infof("cointip: not reversing tip for removed reaction %s - untracked or outside the grace window", key)
+		return
+	}
+
+	// Tips that haven't been sent yet are cancelled when the queue gets to them
+	if rt.TipID != "" {
+		p.reverseReactionTip(key)
+	}
+}
+
+// reverseReactionTip sends a compensating tip from the recipient back to the sender, once.
+func (p *Plugin) reverseReactionTip(key string) {
+	rt, err := p.updateReactionTip(key, func(rt *reactionTip) bool {
+		if rt.TipID == "" || rt.Reversed {
+			return false
+		}
+		rt.Reversed = true
+		return true
+	})
+	if err != nil || rt == nil {
+		return
+	}
+
+	// Reversals aren't subject to spending limits, the recipient never chose to send them
+	record := &tipRecord{From: rt.To, To: rt.From, Channel: rt.Channel, Amount: rt.Amount, Memo: "cointip reversal", Reverses: rt.TipID}
+	err = p.sendTip(record, false)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed reversing tip %s for removed reaction %s", rt.TipID, key)
+		p.updateReactionTip(key, func(rt *reactionTip) bool {
+			rt.Reversed = false
+			return true
+		})
+		return
+	}
+
+	log.Infof("cointip: reversed tip %s for removed reaction %s with %s", rt.TipID, key, record.ID)
+	p.updateReactionTip(key, func(rt *reactionTip) bool {
+		rt.ReversalID = record.ID
+		return true
+	})
+}
+
+// reversalLoop commits delayed tips once their grace window has passed and forgets old tracked tips.
+func (p *Plugin) reversalLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if p.config.ReversalDelayedCommit {
+				p.commitDelayedTips()
+			}
+			p.pruneReactionTips()
+		case <-ctx.Done():
+			log.Info("cointip: stopping tip reversal")
+			return
+		}
+	}
+}
+
+func (p *Plugin) commitDelayedTips() {
+	type delayed struct {
+		key string
+		rt  *reactionTip
+	}
+	due := []*delayed{}
+	p.store.ForEach(delayedTipsBucket, func(key string, value []byte) error {
+		rt := &reactionTip{}
+		if json.Unmarshal(value, rt) == nil && time.Since(rt.CreatedAt) >= p.config.ReversalGrace {
+			due = append(due, &delayed{key: key, rt: rt})
+		}
+		return nil
+	})
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].rt.CreatedAt.Before(due[j].rt.CreatedAt)
+	})
+
+	for _, d := range due {
+		// Claim the tip so a removal racing with us can't cancel it after it's committed
+		claimed := false
+		p.store.Update(delayedTipsBucket, d.key, func(value []byte) ([]byte, error) {
+			claimed = value != nil
+			return nil, nil
+		})
+		if claimed {
+			p.commitReactionTip(d.key, &tipRecord{From: d.rt.From, To: d.rt.To, Channel: d.rt.Channel, Message: d.rt.Message, Amount: d.rt.Amount})
+		}
+	}
+}
+
+// pruneReactionTips forgets tracked tips that are done with: sent and either never removed or reversed. Tips that are
+// still queued or delayed are kept however old they are, or they couldn't be cancelled.
+func (p *Plugin) pruneReactionTips() {
+	expired := []string{}
+	p.store.ForEach(reactionTipsBucket, func(key string, value []byte) error {
+		rt := &reactionTip{}
+		if json.Unmarshal(value, rt) != nil || time.Since(rt.CreatedAt) <= p.config.ReversalGrace+time.Hour {
+			return nil
+		}
+		if rt.TipID != "" && (rt.RemovedAt.IsZero() || rt.ReversalID != "") {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		p.store.Delete(reactionTipsBucket, key)
+	}
+}
@@ -0,0 +1,91 @@
+package cointip
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReactionRemovedReversesTip(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipReversal(time.Minute, false))
+	a := addTestUser(t, p, fc, "A", 10)
+	b := addTestUser(t, p, fc, "B", 0)
+
+	key := reactionKey("A", "C1", "1.0", "cointip_1usd")
+	p.submitReactionTip(key, &tipRecord{From: "A", To: "B", Channel: "C1", Message: "1.0", Amount: usd(1)})
+	if got := fc.usd(b.ID); got != 1 {
+		t.Fatalf("B got $%.2f, want $1.00", got)
+	}
+
+	p.ReactionRemoved("A", "C1", "1.0", "cointip_1usd")
+	if got := fc.usd(a.ID); got != 10 {
+		t.Fatalf("A has $%.2f after the reversal, want $10.00", got)
+	}
+
+	// Removing it again doesn't reverse twice
+	p.ReactionRemoved("A", "C1", "1.0", "cointip_1usd")
+	if n := fc.transferCount(); n != 2 {
+		t.Fatalf("got %d transfers, want the tip and one reversal", n)
+	}
+}
+
+func TestReactionRemovedCancelsQueuedTip(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipReversal(time.Minute, false), WithTipWorkers(1, 1))
+	addTestUser(t, p, fc, "A", 10)
+	addTestUser(t, p, fc, "B", 0)
+
+	key := reactionKey("A", "C1", "1.0", "cointip_1usd")
+	p.submitReactionTip(key, &tipRecord{From: "A", To: "B", Channel: "C1", Message: "1.0", Amount: usd(1)})
+	p.ReactionRemoved("A", "C1", "1.0", "cointip_1usd")
+	runQueue(t, p)
+
+	if n := fc.transferCount(); n != 0 {
+		t.Fatalf("cancelled tip made %d transfers", n)
+	}
+}
+
+func TestFailedReactionTipIsForgotten(t *testing.T) {
+	p, fc := newTestPlugin(t, WithTipReversal(time.Minute, false))
+	addTestUser(t, p, fc, "A", 0)
+	addTestUser(t, p, fc, "B", 0)
+
+	key := reactionKey("A", "C1", "1.0", "cointip_1usd")
+	p.submitReactionTip(key, &tipRecord{From: "A", To: "B", Amount: usd(1)})
+	if rt, _ := p.getReactionTip(key); rt != nil {
+		t.Fatalf("failed tip is still tracked: %+v", rt)
+	}
+}
+
+func TestPruneReactionTipsKeepsUnfinishedTips(t *testing.T) {
+	p, _ := newTestPlugin(t, WithTipReversal(time.Minute, false))
+	old := time.Now().Add(-2 * time.Hour)
+
+	tips := map[string]*reactionTip{
+		"sent":            {TipID: "tx-1", CreatedAt: old},
+		"reversed":        {TipID: "tx-1", CreatedAt: old, RemovedAt: old, Reversed: true, ReversalID: "tx-2"},
+		"queued":          {CreatedAt: old},
+		"removed-queued":  {CreatedAt: old, RemovedAt: old},
+		"reversal-failed": {TipID: "tx-1", CreatedAt: old, RemovedAt: old},
+		"recent":          {TipID: "tx-1", CreatedAt: time.Now()},
+	}
+	for key, rt := range tips {
+		data, _ := json.Marshal(rt)
+		p.store.Put(reactionTipsBucket, key, data)
+	}
+
+	p.pruneReactionTips()
+
+	for key, kept := range map[string]bool{
+		"sent":            false,
+		"reversed":        false,
+		"queued":          true,
+		"removed-queued":  true,
+		"reversal-failed": true,
+		"recent":          true,
+	} {
+		rt, _ := p.getReactionTip(key)
+		if (rt != nil) != kept {
+			t.Errorf("%s: kept %t, want %t", key, rt != nil, kept)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cointip
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jirwin/quadlek/quadlek"
+	log "github.com/sirupsen/logrus"
+)
+
+// subcommand is a /cointip <name> command. Subcommands register themselves from init() in the file that
+// implements them.
+type subcommand struct {
+	Name  string
+	Usage string // Arguments, e.g. "<amount|all> <address-or-email>"
+	Help  string // One line description
+	Admin bool   // Only admins can run or see it
+	Run   func(p *Plugin, cmdMsg *quadlek.CommandMsg, args []*token)
+}
+
+var subcommands = map[string]*subcommand{}
+
+func registerSubcommand(cmd *subcommand) {
+	if _, ok := subcommands[cmd.Name]; ok {
+		panic(fmt.Sprintf("cointip: subcommand %s registered twice", cmd.Name))
+	}
+	subcommands[cmd.Name] = cmd
+}
+
+func (cmd *subcommand) usageString() string {
+	return strings.TrimSpace(fmt.Sprintf("/cointip %s %s", cmd.Name, cmd.Usage))
+}
+
+func sayUsage(cmdMsg *quadlek.CommandMsg, cmd *subcommand) {
+	say(cmdMsg, fmt.Sprintf("usage: %s", cmd.usageString()), false)
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "help",
+		Usage: "[command]",
+		Help:  "Show available commands, or help for one command",
+		Run:   (*Plugin).helpCommand,
+	})
+}
+
+// /cointip help [command]
+func (p *Plugin) helpCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) == 1 {
+		if cmd, ok := subcommands[args[0].Text]; ok && (!cmd.Admin || p.isAdmin(cmdMsg.Command.UserId)) {
+			say(cmdMsg, fmt.Sprintf("%s\n%s", cmd.usageString(), cmd.Help), false)
+			return
+		}
+	}
+	p.help(cmdMsg)
+}
+
+func (p *Plugin) help(cmdMsg *quadlek.CommandMsg) {
+	names := []string{}
+	for name, cmd := range subcommands {
+		if !cmd.Admin || p.isAdmin(cmdMsg.Command.UserId) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := []string{"cointip: Tip your friends!"}
+	for _, name := range names {
+		cmd := subcommands[name]
+		lines = append(lines, fmt.Sprintf("`%s` - %s", cmd.usageString(), cmd.Help))
+	}
+
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+// route tokenizes /cointip <command> <args...> and runs the matching subcommand.
+func (p *Plugin) route(cmdMsg *quadlek.CommandMsg) {
+	tokens, err := tokenize(cmdMsg.Command.Text)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(tokens) == 0 {
+		p.help(cmdMsg)
+		return
+	}
+
+	cmd, ok := subcommands[strings.ToLower(tokens[0].Text)]
+	if !ok || (cmd.Admin && !p.isAdmin(cmdMsg.Command.UserId)) {
+		p.help(cmdMsg)
+		return
+	}
+
+	log.Infof("cointip: got command %s", cmd.Name)
+	cmd.Run(p, cmdMsg, tokens[1:])
+}
@@ -0,0 +1,503 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schedules are recurring tips from a user, or allowances from the bank to everyone with a tipjar. Each run is recorded
+// in the schedule runs bucket, keyed by schedule id and time.
+const (
+	schedulesBucket    = "schedules"
+	scheduleRunsBucket = "schedule_runs"
+	scheduleSeqKey     = "schedule_seq"
+
+	scheduleCheckEvery = time.Minute
+
+	scheduleHistoryCount = 10
+)
+
+const (
+	scheduleTip       = "tip"
+	scheduleAllowance = "allowance"
+)
+
+type schedule struct {
+	ID        string           `json:"id"`
+	Kind      string           `json:"kind"`
+	Owner     string           `json:"owner"` // Who created it, and who tips pay from
+	To        string           `json:"to"`    // Empty for allowances
+	Amount    *cointip.Balance `json:"amount"`
+	Memo      string           `json:"memo"`
+	Spec      string           `json:"spec"`     // As the user wrote it, without the time zone
+	Location  string           `json:"location"` // Time zone Spec is in, UTC if empty
+	Next      time.Time        `json:"next"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type scheduleRun struct {
+	Time   time.Time `json:"time"`
+	Sent   []string  `json:"sent"` // Tip ids
+	Failed []string  `json:"failed"`
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "schedule",
+		Usage: "@user <amount> \"<when>\" [memo] | allowance <amount> \"<when>\" | list | cancel <id> | history <id>",
+		Help:  "Tip someone on a schedule, e.g. \"every friday at 17:00 in Europe/Berlin\" or a cron expression",
+		Run:   (*Plugin).scheduleCommand,
+	})
+}
+
+func (p *Plugin) saveSchedule(s *schedule) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(schedulesBucket, s.ID, data)
+}
+
+// loadSchedules returns the schedules matching fn, by id.
+func (p *Plugin) loadSchedules(fn func(s *schedule) bool) ([]*schedule, error) {
+	schedules := []*schedule{}
+	err := p.store.ForEach(schedulesBucket, func(key string, value []byte) error {
+		s := &schedule{}
+		err := json.Unmarshal(value, s)
+		if err != nil {
+			return fmt.Errorf("invalid schedule %s: %s", key, err)
+		}
+		if fn(s) {
+			schedules = append(schedules, s)
+		}
+		return nil
+	})
+	sort.Slice(schedules, func(i, j int) bool {
+		a, _ := strconv.Atoi(schedules[i].ID)
+		b, _ := strconv.Atoi(schedules[j].ID)
+		return a < b
+	})
+	return schedules, err
+}
+
+func (p *Plugin) scheduleString(s *schedule, userId string) string {
+	what := fmt.Sprintf("%s to <@%s>", p.displayAmount(userId, s.Amount), s.To)
+	if s.Kind == scheduleAllowance {
+		what = fmt.Sprintf("%s allowance for everyone", p.displayAmount(userId, s.Amount))
+	}
+	line := fmt.Sprintf("#%s %s %s in %s, next %s", s.ID, what, s.Spec, s.locationName(), s.nextString())
+	if s.Memo != "" {
+		line += fmt.Sprintf(": %s", s.Memo)
+	}
+	return line
+}
+
+// /cointip schedule @user <amount> "<when>" [memo]
+// /cointip schedule allowance <amount> "<when>"
+// /cointip schedule list
+// /cointip schedule cancel <id>
+// /cointip schedule history <id>
+func (p *Plugin) scheduleCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) == 0 {
+		sayUsage(cmdMsg, subcommands["schedule"])
+		return
+	}
+
+	switch strings.ToLower(args[0].Text) {
+	case "list":
+		p.listSchedules(cmdMsg)
+	case "cancel":
+		p.cancelSchedule(cmdMsg, args[1:])
+	case "history":
+		p.scheduleHistory(cmdMsg, args[1:])
+	case "allowance":
+		if !p.isAdmin(cmdMsg.Command.UserId) {
+			say(cmdMsg, "only admins can set up allowances", false)
+			return
+		}
+		p.createSchedule(cmdMsg, scheduleAllowance, "", args[1:])
+	default:
+		to, err := args[0].user(cmdMsg.Bot)
+		if err != nil {
+			say(cmdMsg, err.Error(), false)
+			return
+		}
+		if to == cmdMsg.Command.UserId {
+			say(cmdMsg, errSelfTip.Error(), false)
+			return
+		}
+		p.createSchedule(cmdMsg, scheduleTip, to, args[1:])
+	}
+}
+
+// scheduleLocation loads a schedule's time zone, UTC unless it names another.
+func scheduleLocation(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "utc") {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// splitLocation splits an optional trailing "in <zone>" off a schedule, as in "daily at 9:00 in Europe/Berlin".
+func splitLocation(text string) (string, *time.Location, error) {
+	words := strings.Fields(text)
+	if len(words) < 2 || !strings.EqualFold(words[len(words)-2], "in") {
+		return text, time.UTC, nil
+	}
+	loc, err := scheduleLocation(words[len(words)-1])
+	if err != nil {
+		return "", nil, fmt.Errorf("unknown time zone %q, use a name like Europe/Berlin", words[len(words)-1])
+	}
+	return strings.Join(words[:len(words)-2], " "), loc, nil
+}
+
+func (s *schedule) locationName() string {
+	if s.Location == "" {
+		return "UTC"
+	}
+	return s.Location
+}
+
+// nextString formats the next run in the schedule's time zone.
+func (s *schedule) nextString() string {
+	next := s.Next
+	if loc, err := scheduleLocation(s.Location); err == nil {
+		next = next.In(loc)
+	}
+	return next.Format("Mon Jan 2 15:04 MST")
+}
+
+func (p *Plugin) createSchedule(cmdMsg *quadlek.CommandMsg, kind, to string, args []*token) {
+	if len(args) < 2 {
+		sayUsage(cmdMsg, subcommands["schedule"])
+		return
+	}
+
+	amount, err := args[0].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	// Catch amounts that can't be converted now rather than on every run
+	_, err = p.transferAmount(amount)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	when, loc, err := splitLocation(args[1].Text)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	spec, err := parseSchedule(when)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	next := spec.next(time.Now().In(loc))
+	if next.IsZero() {
+		say(cmdMsg, fmt.Sprintf("%q never happens", args[1].Text), false)
+		return
+	}
+
+	id, err := p.nextId(scheduleSeqKey)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed allocating schedule id")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	s := &schedule{
+		ID:        id,
+		Kind:      kind,
+		Owner:     cmdMsg.Command.UserId,
+		To:        to,
+		Amount:    amount,
+		Memo:      joinTokens(args[2:]),
+		Spec:      when,
+		Location:  loc.String(),
+		Next:      next.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	err = p.saveSchedule(s)
+	if err != nil {
+		log.WithError(err).Error("cointip: failed saving schedule")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: %s created %s schedule #%s %s %q", s.Owner, s.Kind, s.ID, amountString(amount), s.Spec)
+	say(cmdMsg, fmt.Sprintf("scheduled %s\n`/cointip schedule cancel %s` to stop it", p.scheduleString(s, s.Owner), s.ID), false)
+}
+
+// /cointip schedule list
+func (p *Plugin) listSchedules(cmdMsg *quadlek.CommandMsg) {
+	userId := cmdMsg.Command.UserId
+	admin := p.isAdmin(userId)
+	schedules, err := p.loadSchedules(func(s *schedule) bool {
+		return s.Owner == userId || s.To == userId || (admin && s.Kind == scheduleAllowance)
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed loading schedules")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(schedules) == 0 {
+		say(cmdMsg, "no schedules", false)
+		return
+	}
+
+	lines := []string{"schedules:"}
+	for _, s := range schedules {
+		line := p.scheduleString(s, userId)
+		if s.Owner != userId {
+			line += fmt.Sprintf(" (from <@%s>)", s.Owner)
+		}
+		lines = append(lines, line)
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+// findSchedule loads a schedule the user owns, or any schedule for admins.
+func (p *Plugin) findSchedule(userId, id string) (*schedule, error) {
+	id = strings.TrimPrefix(id, "#")
+	data, err := p.store.Get(schedulesBucket, id)
+	if err != nil {
+		return nil, err
+	}
+	s := &schedule{}
+	if data == nil || json.Unmarshal(data, s) != nil {
+		return nil, fmt.Errorf("no schedule #%s", id)
+	}
+	if s.Owner != userId && !p.isAdmin(userId) {
+		return nil, fmt.Errorf("schedule #%s isn't yours", id)
+	}
+	return s, nil
+}
+
+// /cointip schedule cancel <id>
+func (p *Plugin) cancelSchedule(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, subcommands["schedule"])
+		return
+	}
+	s, err := p.findSchedule(cmdMsg.Command.UserId, args[0].Text)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	// Runs are kept, so there's a record of what the schedule did
+	err = p.store.Delete(schedulesBucket, s.ID)
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed cancelling schedule #%s", s.ID)
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	log.Infof("cointip: %s cancelled schedule #%s", cmdMsg.Command.UserId, s.ID)
+	say(cmdMsg, fmt.Sprintf("cancelled %s", p.scheduleString(s, cmdMsg.Command.UserId)), false)
+}
+
+// /cointip schedule history <id>
+func (p *Plugin) scheduleHistory(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) != 1 {
+		sayUsage(cmdMsg, subcommands["schedule"])
+		return
+	}
+	s, err := p.findSchedule(cmdMsg.Command.UserId, args[0].Text)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	runs := []*scheduleRun{}
+	prefix := s.ID + "/"
+	err = p.store.ForEach(scheduleRunsBucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		run := &scheduleRun{}
+		if json.Unmarshal(value, run) == nil {
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed loading schedule runs")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(runs) == 0 {
+		say(cmdMsg, fmt.Sprintf("schedule #%s hasn't run yet, next run %s", s.ID, s.nextString()), false)
+		return
+	}
+
+	lines := []string{p.scheduleString(s, cmdMsg.Command.UserId)}
+	for i := len(runs) - 1; i >= 0 && i >= len(runs)-scheduleHistoryCount; i-- {
+		run := runs[i]
+		line := fmt.Sprintf("%s sent %d", run.Time.Format("Jan 2 15:04"), len(run.Sent))
+		if len(run.Failed) > 0 {
+			line += fmt.Sprintf(", failed: %s", strings.Join(run.Failed, "; "))
+		}
+		lines = append(lines, line)
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+// claimSchedule moves a due schedule's next run forward before it runs, so a run is never repeated. A run missed while
+// the bot was down happens once, late.
+func (p *Plugin) claimSchedule(id string, now time.Time) (*schedule, error) {
+	var claimed *schedule
+	err := p.store.Update(schedulesBucket, id, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, nil
+		}
+		s := &schedule{}
+		err := json.Unmarshal(value, s)
+		if err != nil {
+			return nil, err
+		}
+		if s.Next.After(now) {
+			return value, nil
+		}
+		spec, err := parseSchedule(s.Spec)
+		if err != nil {
+			return nil, err
+		}
+		loc, err := scheduleLocation(s.Location)
+		if err != nil {
+			return nil, err
+		}
+		claimed = &schedule{}
+		*claimed = *s
+		s.Next = spec.next(now.In(loc)).UTC()
+		if s.Next.IsZero() {
+			return nil, nil
+		}
+		return json.Marshal(s)
+	})
+	return claimed, err
+}
+
+// runSchedule makes one run of a schedule and records it.
+func (p *Plugin) runSchedule(s *schedule) {
+	run := &scheduleRun{Time: time.Now().UTC()}
+
+	switch s.Kind {
+	case scheduleTip:
+		memo := s.Memo
+		if memo == "" {
+			memo = fmt.Sprintf("cointip schedule #%s", s.ID)
+		}
+		t := &tipRecord{From: s.Owner, To: s.To, Amount: s.Amount, Memo: memo}
+		err := p.tip(t)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: scheduled tip #%s failed", s.ID)
+			run.Failed = append(run.Failed, err.Error())
+			p.notifyTipFailed(t, fmt.Sprintf("%s (schedule #%s)", err, s.ID))
+		} else {
+			run.Sent = append(run.Sent, t.ID)
+		}
+
+	case scheduleAllowance:
+		p.runAllowance(s, run)
+	}
+
+	data, err := json.Marshal(run)
+	if err == nil {
+		err = p.store.Put(scheduleRunsBucket, fmt.Sprintf("%s/%020d", s.ID, run.Time.UnixNano()), data)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("cointip: failed recording run of schedule #%s", s.ID)
+	}
+	log.Infof("cointip: ran schedule #%s sent %d failed %d", s.ID, len(run.Sent), len(run.Failed))
+}
+
+// runAllowance gives everyone with a tipjar the allowance from the bank, leaving out bots and deactivated users.
+func (p *Plugin) runAllowance(s *schedule, run *scheduleRun) {
+	bot := p.getBot()
+	if bot == nil {
+		run.Failed = append(run.Failed, "can't look up slack users yet")
+		return
+	}
+
+	users := []string{}
+	p.store.ForEach(accountsBucket, func(key string, value []byte) error {
+		if !internalUser(key) && key != p.bankUserId {
+			users = append(users, key)
+		}
+		return nil
+	})
+
+	memo := s.Memo
+	if memo == "" {
+		memo = "cointip allowance"
+	}
+	for _, userId := range users {
+		if !p.rainEligible(bot, userId) {
+			continue
+		}
+		t := &tipRecord{From: p.bankUserId, To: userId, Amount: s.Amount, Memo: memo}
+		err := p.sendTip(t, false)
+		// sendTip wraps the coinbase error
+		if cointip.IsInsufficientFunds(errors.Unwrap(err)) {
+			p.opsAlert("bank can't cover allowance #%s, %d of %d users got %s", s.ID, len(run.Sent), len(users), amountString(s.Amount))
+			run.Failed = append(run.Failed, "bank ran out")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Errorf("cointip: allowance #%s to %s failed", s.ID, userId)
+			run.Failed = append(run.Failed, fmt.Sprintf("<@%s> (%s)", userId, err))
+			continue
+		}
+		run.Sent = append(run.Sent, t.ID)
+		p.dm(userId, fmt.Sprintf("You got your %s allowance, happy tipping!", p.displayAmount(userId, t.Amount)))
+	}
+}
+
+// runDueSchedules runs every schedule whose next run has come.
+func (p *Plugin) runDueSchedules() {
+	now := time.Now()
+	due, err := p.loadSchedules(func(s *schedule) bool {
+		return !s.Next.After(now)
+	})
+	if err != nil {
+		log.WithError(err).Error("cointip: failed loading schedules")
+	}
+
+	for _, s := range due {
+		claimed, err := p.claimSchedule(s.ID, now)
+		if err != nil {
+			log.WithError(err).Errorf("cointip: failed claiming schedule #%s", s.ID)
+			continue
+		}
+		if claimed != nil {
+			p.runSchedule(claimed)
+		}
+	}
+}
+
+func (p *Plugin) scheduleLoop(ctx context.Context) {
+	ticker := time.NewTicker(scheduleCheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.runDueSchedules()
+		case <-ctx.Done():
+			log.Info("cointip: stopping scheduler")
+			return
+		}
+	}
+}
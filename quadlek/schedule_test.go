@@ -0,0 +1,38 @@
+package cointip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/morgabra/cointip"
+)
+
+func TestScheduledTipIgnoresChannelLimits(t *testing.T) {
+	// Scheduled tips aren't made in a channel, so an allowlist of channels doesn't refuse them
+	p, fc := newTestPlugin(t, WithLimits(Limits{Currency: cointip.CurrencyUSD, Channels: []string{"C1"}}))
+	addTestUser(t, p, fc, "A", 10)
+	to := addTestUser(t, p, fc, "B", 0)
+
+	s := &schedule{
+		ID:        "1",
+		Kind:      scheduleTip,
+		Owner:     "A",
+		To:        "B",
+		Amount:    usd(2),
+		Spec:      "daily at 9:00",
+		Next:      time.Now().UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := p.saveSchedule(s); err != nil {
+		t.Fatal(err)
+	}
+	p.runSchedule(s)
+
+	if got := fc.usd(to.ID); got != 2 {
+		t.Fatalf("recipient has $%.2f, want $2.00", got)
+	}
+	spends, _ := p.loadSpends("A")
+	if len(spends) != 1 {
+		t.Fatalf("got %d spends, want the scheduled tip counted", len(spends))
+	}
+}
@@ -0,0 +1,190 @@
+package cointip
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store persists plugin state as keys and values grouped into buckets.
+type Store interface {
+	// Get returns nil if the key doesn't exist.
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// Update atomically replaces the value of a key. fn gets nil if the key doesn't exist, and deletes it by
+	// returning nil.
+	Update(bucket, key string, fn func(value []byte) ([]byte, error)) error
+	// ForEach visits every key in a bucket in key order. fn must not write to the store.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+// MemoryStore keeps everything in process memory. State is lost on restart.
+type MemoryStore struct {
+	lock    sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]map[string][]byte{},
+	}
+}
+
+func (s *MemoryStore) Get(bucket, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buckets[bucket][key], nil
+}
+
+func (s *MemoryStore) Put(bucket, key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(bucket, key, value)
+	return nil
+}
+
+func (s *MemoryStore) put(bucket, key string, value []byte) {
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string][]byte{}
+	}
+	s.buckets[bucket][key] = append([]byte{}, value...)
+}
+
+func (s *MemoryStore) Delete(bucket, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStore) Update(bucket, key string, fn func(value []byte) ([]byte, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, err := fn(s.buckets[bucket][key])
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(s.buckets[bucket], key)
+		return nil
+	}
+	s.put(bucket, key, value)
+	return nil
+}
+
+func (s *MemoryStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	s.lock.Lock()
+	keys := []string{}
+	values := map[string][]byte{}
+	for k, v := range s.buckets[bucket] {
+		keys = append(keys, k)
+		values[k] = v
+	}
+	s.lock.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := fn(k, values[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// BoltStore keeps state in a BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			// Values are only valid for the life of the transaction
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) Update(bucket, key string, fn func(value []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		var current []byte
+		if v := b.Get([]byte(key)); v != nil {
+			current = append([]byte{}, v...)
+		}
+
+		value, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), append([]byte{}, v...))
+		})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
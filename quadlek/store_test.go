@@ -0,0 +1,208 @@
+package cointip
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testStores runs fn against every Store implementation.
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cointip-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		s, err := NewBoltStore(filepath.Join(dir, "cointip.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+func TestStoreGetPutDelete(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		value, err := s.Get("accounts", "U1")
+		if err != nil || value != nil {
+			t.Fatalf("Get of a missing key: got %q, %v", value, err)
+		}
+
+		err = s.Put("accounts", "U1", []byte("acct-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err = s.Get("accounts", "U1")
+		if err != nil || string(value) != "acct-1" {
+			t.Fatalf("Get: got %q, %v", value, err)
+		}
+
+		// Buckets are separate
+		value, err = s.Get("other", "U1")
+		if err != nil || value != nil {
+			t.Fatalf("Get from another bucket: got %q, %v", value, err)
+		}
+
+		err = s.Delete("accounts", "U1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err = s.Get("accounts", "U1")
+		if err != nil || value != nil {
+			t.Fatalf("Get after Delete: got %q, %v", value, err)
+		}
+
+		err = s.Delete("missing", "U1")
+		if err != nil {
+			t.Fatalf("Delete of a missing key: %s", err)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.Update("meta", "key", func(value []byte) ([]byte, error) {
+			if value != nil {
+				t.Errorf("Update of a missing key: got %q", value)
+			}
+			return []byte("1"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Update("meta", "key", func(value []byte) ([]byte, error) {
+			if string(value) != "1" {
+				t.Errorf("Update: got %q, want 1", value)
+			}
+			return []byte("2"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An error leaves the value alone
+		failed := errors.New("nope")
+		err = s.Update("meta", "key", func(value []byte) ([]byte, error) {
+			return []byte("3"), failed
+		})
+		if err != failed {
+			t.Fatalf("Update: got %v, want %v", err, failed)
+		}
+		value, _ := s.Get("meta", "key")
+		if string(value) != "2" {
+			t.Fatalf("failed Update changed the value to %q", value)
+		}
+
+		// Returning nil deletes
+		err = s.Update("meta", "key", func(value []byte) ([]byte, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ = s.Get("meta", "key")
+		if value != nil {
+			t.Fatalf("Update returning nil left %q", value)
+		}
+	})
+}
+
+func TestStoreUpdateIsAtomic(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Update("meta", "count", func(value []byte) ([]byte, error) {
+					n, _ := strconv.Atoi(string(value))
+					return []byte(strconv.Itoa(n + 1)), nil
+				})
+			}()
+		}
+		wg.Wait()
+
+		value, _ := s.Get("meta", "count")
+		if string(value) != "50" {
+			t.Fatalf("50 concurrent increments: got %q", value)
+		}
+	})
+}
+
+func TestStoreForEach(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.ForEach("empty", func(key string, value []byte) error {
+			t.Errorf("ForEach of an empty bucket visited %s", key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"b", "c", "a"} {
+			s.Put("bucket", key, []byte("value-"+key))
+		}
+
+		keys := []string{}
+		err = s.ForEach("bucket", func(key string, value []byte) error {
+			if string(value) != "value-"+key {
+				t.Errorf("ForEach %s: got %q", key, value)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+			t.Fatalf("ForEach: got keys %v, want them in order", keys)
+		}
+
+		stop := errors.New("stop")
+		visited := 0
+		err = s.ForEach("bucket", func(key string, value []byte) error {
+			visited++
+			return stop
+		})
+		if err != stop || visited != 1 {
+			t.Fatalf("ForEach returning an error: got %v after %d keys", err, visited)
+		}
+	})
+}
+
+func TestBoltStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cointip-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cointip.db")
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(accountsBucket, "U1", []byte("acct-1"))
+	s.Close()
+
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	value, err := s.Get(accountsBucket, "U1")
+	if err != nil || string(value) != "acct-1" {
+		t.Fatalf("Get after reopening: got %q, %v", value, err)
+	}
+}
@@ -0,0 +1,178 @@
+package cointip
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+var errSelfTip = errors.New("you can't tip yourself")
+
+// transferError is an error from the coinbase transfer call itself. Unless coinbase says otherwise, the transfer may
+// or may not have gone through.
+type transferError struct {
+	err error
+}
+
+func (e *transferError) Error() string {
+	return fmt.Sprintf("failed creating transaction: %s", e.err)
+}
+
+func (e *transferError) Unwrap() error {
+	return e.err
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "tip",
+		Usage: "@user <amount> [memo]",
+		Help:  "Tip someone from your tipjar",
+		Run:   (*Plugin).tipCommand,
+	})
+}
+
+// tipRecord describes a tip to make, and once it's made its id and time.
+type tipRecord struct {
+	ID       string           `json:"id"` // Coinbase transaction id, or ledger entry id in ledger mode
+	Ledger   bool             `json:"ledger"`
+	From     string           `json:"from"` // Slack user ids
+	To       string           `json:"to"`
+	Channel  string           `json:"channel"` // Where the tip was made, if anywhere
+	Message  string           `json:"message"` // Timestamp of the message that was tipped, if any
+	Amount   *cointip.Balance `json:"amount"`
+	Memo     string           `json:"memo"`
+	Reverses string           `json:"reverses"` // ID of the tip this sends back, for reversals
+	Time     time.Time        `json:"time"`
+}
+
+// tip moves t.Amount from one user's tipjar to another's after checking the spending limits. The memo, if any, becomes
+// the coinbase transaction description. In ledger mode the tip is only recorded in the ledger and settled later.
+func (p *Plugin) tip(t *tipRecord) error {
+	err := p.sendTip(t, true)
+	if err != nil {
+		return err
+	}
+	p.notifyTipSent(t)
+	return nil
+}
+
+func (p *Plugin) sendTip(t *tipRecord, checkLimits bool) error {
+	if t.From == t.To {
+		return errSelfTip
+	}
+
+	// Amounts in currencies coinbase can't transfer are sent as BTC
+	amount, err := p.transferAmount(t.Amount)
+	if err != nil {
+		return err
+	}
+	t.Amount = amount
+
+	from, err := p.getOrCreateAccount(t.From)
+	if err != nil {
+		return fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+
+	// Tips are counted against the limits before they're sent, and given back if they don't go through
+	var reserved *spend
+	if checkLimits {
+		err = p.checkFrozen(t.From)
+		if err != nil {
+			return err
+		}
+		reserved, err = p.reserveTipSpend(t, from)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.transferTip(t, from)
+	if err != nil {
+		if !mayHaveTransferred(err) {
+			p.releaseSpend(t.From, reserved)
+		}
+		return err
+	}
+	p.logTip(t)
+	return nil
+}
+
+// transferTip moves a tip to the recipient, or records it in the ledger in ledger mode.
+func (p *Plugin) transferTip(t *tipRecord, from *cointip.Account) error {
+	to, err := p.getOrCreateAccount(t.To)
+	if err != nil {
+		return fmt.Errorf("failed fetching coinbase account: %w", err)
+	}
+
+	t.Ledger = p.config.Ledger
+	t.Time = time.Now().UTC()
+
+	if p.config.Ledger {
+		entry, err := p.ledgerTip(t.From, t.To, t.Amount, t.Memo)
+		if isLimitError(err) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed recording tip: %w", err)
+		}
+		t.ID = entry.ID
+		log.Infof("%s (%s) tipped %s (%s) %s ledger entry: %s", from.Name, from.ID, to.Name, to.ID, amountString(t.Amount), entry.ID)
+		return nil
+	}
+
+	description := "cointip tip"
+	if t.Memo != "" {
+		description = t.Memo
+	}
+
+	tx, err := p.client.TransferWithDescription(from.ID, to.ID, t.Amount, description)
+	if err != nil {
+		return &transferError{err}
+	}
+	t.ID = tx.ID
+	log.Infof("%s (%s) tipped %s (%s) %s:%.2f txid: %s", from.Name, from.ID, to.Name, to.ID, tx.NativeAmount.Currency, tx.NativeAmount.Amount, tx.ID)
+	return nil
+}
+
+// /cointip tip @user <amount> [memo]
+func (p *Plugin) tipCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	if len(args) < 2 {
+		sayUsage(cmdMsg, subcommands["tip"])
+		return
+	}
+
+	to, err := args[0].user(cmdMsg.Bot)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	amount, err := args[1].amount()
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	memo := joinTokens(args[2:])
+
+	err = p.tip(&tipRecord{From: cmdMsg.Command.UserId, To: to, Channel: cmdMsg.Command.ChannelId, Amount: amount, Memo: memo})
+	if err == errSelfTip || isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: tip failed")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	msg := fmt.Sprintf("<@%s> tipped <@%s> %s", cmdMsg.Command.UserId, to, amountString(amount))
+	if memo != "" {
+		msg += fmt.Sprintf(": %s", memo)
+	}
+	say(cmdMsg, msg, true)
+}
@@ -0,0 +1,256 @@
+package cointip
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Network fee we pay for sends to a BTC address. Sends to a coinbase email are off-chain and free.
+var withdrawNetworkFee = &cointip.Balance{Currency: cointip.CurrencyBTC, Amount: 0.0001}
+
+// How long a quoted withdraw waits for confirmation.
+const withdrawConfirmWindow = 5 * time.Minute
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+var mailtoRegexp = regexp.MustCompile(`^<mailto:([^|>]+)(\|[^>]*)?>$`)
+var btcAddressRegexp = regexp.MustCompile(`^([13][a-km-zA-HJ-NP-Z1-9]{25,34}|bc1[ac-hj-np-z02-9]{11,71})$`)
+
+type pendingWithdraw struct {
+	To        string
+	Amount    *cointip.Balance
+	Fee       *cointip.Balance // nil for sends to an email
+	ExpiresAt time.Time
+}
+
+func init() {
+	registerSubcommand(&subcommand{
+		Name:  "withdraw",
+		Usage: "<amount|all> <btc-address-or-email> | confirm [2fa-code] | cancel",
+		Help:  "Send funds out of your tipjar",
+		Run:   (*Plugin).withdrawCommand,
+	})
+}
+
+// parseDestination validates a BTC address or email, unwrapping slack's mailto formatting. Returns true if the
+// destination is an email.
+func parseDestination(dest string) (string, bool, error) {
+	if m := mailtoRegexp.FindStringSubmatch(dest); m != nil {
+		dest = m[1]
+	}
+	if emailRegexp.MatchString(dest) {
+		return dest, true, nil
+	}
+	if btcAddressRegexp.MatchString(dest) {
+		return dest, false, nil
+	}
+	return "", false, fmt.Errorf("%q is not a BTC address or email", dest)
+}
+
+func withdrawQuoteString(w *pendingWithdraw) string {
+	msg := fmt.Sprintf("withdraw %s to %s\n", amountString(w.Amount), w.To)
+	if w.Fee != nil {
+		msg += fmt.Sprintf("network fee: %s (paid on top of the amount)\n", amountString(w.Fee))
+	} else {
+		msg += "network fee: none (coinbase to coinbase)\n"
+	}
+	msg += fmt.Sprintf("`/cointip withdraw confirm` within %s to send, or `/cointip withdraw cancel`", withdrawConfirmWindow)
+	return msg
+}
+
+// /cointip withdraw <amount|all> <address-or-email>
+// /cointip withdraw confirm [2fa-token]
+// /cointip withdraw cancel
+func (p *Plugin) withdrawCommand(cmdMsg *quadlek.CommandMsg, args []*token) {
+	userId := cmdMsg.Command.UserId
+
+	err := p.checkFrozen(userId)
+	if isLimitError(err) {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+	if err != nil {
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	if len(args) >= 1 && args[0].Text == "confirm" {
+		code := ""
+		if len(args) > 1 {
+			code = args[1].Text
+		}
+		p.confirmWithdraw(cmdMsg, code)
+		return
+	}
+
+	if len(args) == 1 && args[0].Text == "cancel" {
+		p.pendingWithdrawsLock.Lock()
+		delete(p.pendingWithdraws, userId)
+		p.pendingWithdrawsLock.Unlock()
+		say(cmdMsg, "withdraw cancelled", false)
+		return
+	}
+
+	if len(args) != 2 {
+		sayUsage(cmdMsg, subcommands["withdraw"])
+		return
+	}
+
+	to, isEmail, err := parseDestination(args[1].Text)
+	if err != nil {
+		say(cmdMsg, err.Error(), false)
+		return
+	}
+
+	// Unsettled tips have to land in coinbase before we can quote what's available
+	if p.config.Ledger {
+		err = p.settleUserAll(userId)
+		if err != nil {
+			log.WithError(err).Error("cointip: withdraw failed - failed settling ledger.")
+			sayError(cmdMsg, err.Error(), false)
+			return
+		}
+	}
+
+	account, err := p.getOrCreateAccount(userId)
+	if err != nil {
+		log.WithError(err).Error("cointip: withdraw failed - failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	w := &pendingWithdraw{
+		To:        to,
+		ExpiresAt: time.Now().Add(withdrawConfirmWindow),
+	}
+	if !isEmail {
+		w.Fee = withdrawNetworkFee
+	}
+
+	if args[0].Text == "all" {
+		w.Amount = &cointip.Balance{Currency: account.Balance.Currency, Amount: account.Balance.Amount}
+		if w.Fee != nil && w.Fee.Currency == w.Amount.Currency {
+			w.Amount.Amount -= w.Fee.Amount
+		}
+	} else {
+		w.Amount, err = args[0].amount()
+		if err != nil {
+			say(cmdMsg, err.Error(), false)
+			return
+		}
+		// Amounts in other currencies are converted to the account's currency at the current rate
+		if w.Amount.Currency != account.Balance.Currency && w.Amount.Currency != account.NativeBalance.Currency {
+			w.Amount, err = p.convert(w.Amount, account.Balance.Currency)
+			if err != nil {
+				log.WithError(err).Error("cointip: withdraw failed - failed converting amount")
+				sayError(cmdMsg, fmt.Sprintf("can't withdraw %s right now: %s", args[0].Text, err), false)
+				return
+			}
+		}
+	}
+
+	if w.Amount.Amount <= 0 || !hasFunds(account, w) {
+		say(cmdMsg, fmt.Sprintf("your tipjar doesn't have enough to cover that (balance: %s)", accountBalanceString(account)), false)
+		return
+	}
+
+	p.pendingWithdrawsLock.Lock()
+	p.pendingWithdraws[userId] = w
+	p.pendingWithdrawsLock.Unlock()
+
+	say(cmdMsg, withdrawQuoteString(w), false)
+}
+
+// hasFunds checks the withdraw amount and fee against the account balance.
+func hasFunds(account *cointip.Account, w *pendingWithdraw) bool {
+	fee := 0.0
+	if w.Fee != nil && w.Fee.Currency == account.Balance.Currency {
+		fee = w.Fee.Amount
+	}
+
+	switch w.Amount.Currency {
+	case account.Balance.Currency:
+		return w.Amount.Amount+fee <= account.Balance.Amount
+	case account.NativeBalance.Currency:
+		if account.Balance.Amount == 0 {
+			return false
+		}
+		// Convert the fee into native currency at the account's current rate
+		rate := account.NativeBalance.Amount / account.Balance.Amount
+		return w.Amount.Amount+fee*rate <= account.NativeBalance.Amount
+	}
+	return false
+}
+
+func (p *Plugin) confirmWithdraw(cmdMsg *quadlek.CommandMsg, token string) {
+	userId := cmdMsg.Command.UserId
+
+	p.pendingWithdrawsLock.Lock()
+	w, ok := p.pendingWithdraws[userId]
+	delete(p.pendingWithdraws, userId)
+	p.pendingWithdrawsLock.Unlock()
+
+	if !ok || time.Now().After(w.ExpiresAt) {
+		say(cmdMsg, "nothing to confirm - start over with `/cointip withdraw <amount|all> <btc-address-or-email>`", false)
+		return
+	}
+
+	// Tips made since the quote must be settled too, or the user could withdraw money they've already tipped away
+	if p.config.Ledger {
+		err := p.settleUserAll(userId)
+		if err != nil {
+			log.WithError(err).Error("cointip: withdraw failed - failed settling ledger.")
+			sayError(cmdMsg, err.Error(), false)
+			return
+		}
+	}
+
+	account, err := p.getOrCreateAccount(userId)
+	if err != nil {
+		log.WithError(err).Error("cointip: withdraw failed - failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	tx, err := p.client.Withdraw(account.ID, w.To, w.Amount, &cointip.WithdrawOptions{Fee: w.Fee, TwoFactorToken: token})
+	if cointip.IsTwoFactorRequired(err) {
+		// Keep the withdraw around so it can be confirmed again with a token
+		p.pendingWithdrawsLock.Lock()
+		w.ExpiresAt = time.Now().Add(withdrawConfirmWindow)
+		p.pendingWithdraws[userId] = w
+		p.pendingWithdrawsLock.Unlock()
+
+		msg := "coinbase needs a two-factor code to approve this withdraw. Ask the bot operator for one and run `/cointip withdraw confirm <code>`"
+		if token != "" {
+			msg = "that two-factor code was rejected, try again with `/cointip withdraw confirm <code>`"
+		}
+		say(cmdMsg, msg, false)
+		return
+	}
+	if cointip.IsInsufficientFunds(err) {
+		say(cmdMsg, fmt.Sprintf("your tipjar doesn't have enough to cover %s plus fees (balance: %s)", amountString(w.Amount), accountBalanceString(account)), false)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("cointip: withdraw failed - failed creating transaction.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	log.Infof("cointip: %s (%s) withdrew %s to %s txid: %s", account.Name, account.ID, amountString(w.Amount), w.To, tx.ID)
+
+	msg := fmt.Sprintf("withdraw %s to %s: %s (txid: %s)", amountString(w.Amount), w.To, tx.Status, tx.ID)
+	if tx.Network != nil {
+		if tx.Network.TransactionFee != nil {
+			msg += fmt.Sprintf("\nnetwork fee: %s", amountString(tx.Network.TransactionFee))
+		}
+		if tx.Network.Hash != "" {
+			msg += fmt.Sprintf("\nhash: %s", tx.Network.Hash)
+		}
+	}
+	say(cmdMsg, msg, false)
+}
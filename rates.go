@@ -0,0 +1,46 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// https://developers.coinbase.com/api/v2#exchange-rates
+type ExchangeRates struct {
+	Currency string            `json:"currency"`
+	Rates    map[string]string `json:"rates"`
+}
+
+// Rate returns how much of currency one unit of r.Currency is worth.
+func (r *ExchangeRates) Rate(currency string) (float64, error) {
+	if currency == r.Currency {
+		return 1, nil
+	}
+	rate, ok := r.Rates[currency]
+	if !ok {
+		return 0, fmt.Errorf("no %s rate for %s", r.Currency, currency)
+	}
+	return strconv.ParseFloat(rate, 64)
+}
+
+// GetExchangeRates returns the rates from the given currency to every currency coinbase knows about.
+func (c *ApiKeyClient) GetExchangeRates(currency string) (*ExchangeRates, error) {
+
+	code, body, err := c.Request("GET", fmt.Sprintf("exchange-rates?currency=%s", currency), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	rates := &ExchangeRates{}
+	err = json.Unmarshal(body, rates)
+	if err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
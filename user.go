@@ -0,0 +1,102 @@
+package cointip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Scopes the API key needs for the cointip plugin to work.
+const (
+	ScopeAccountsRead         = "wallet:accounts:read"
+	ScopeAccountsCreate       = "wallet:accounts:create"
+	ScopeAddressesCreate      = "wallet:addresses:create"
+	ScopeTransactionsRead     = "wallet:transactions:read"
+	ScopeTransactionsTransfer = "wallet:transactions:transfer"
+	ScopeTransactionsSend     = "wallet:transactions:send"
+)
+
+// TipScopes are required for creating tipjars and tipping between them.
+var TipScopes = []string{
+	ScopeAccountsRead,
+	ScopeAccountsCreate,
+	ScopeAddressesCreate,
+	ScopeTransactionsRead,
+	ScopeTransactionsTransfer,
+}
+
+// WithdrawScopes are required for sending funds out of a tipjar.
+var WithdrawScopes = []string{
+	ScopeTransactionsSend,
+}
+
+type User struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Username       string `json:"username"`
+	Email          string `json:"email"`
+	TimeZone       string `json:"time_zone"`
+	NativeCurrency string `json:"native_currency"`
+	CreatedAt      string `json:"created_at"`
+}
+
+type Auth struct {
+	Method string   `json:"method"`
+	Scopes []string `json:"scopes"`
+}
+
+// MissingScopes returns the required scopes the current key does not have.
+func (a *Auth) MissingScopes(required []string) []string {
+	have := map[string]bool{}
+	for _, scope := range a.Scopes {
+		have[scope] = true
+	}
+
+	missing := []string{}
+	for _, scope := range required {
+		if !have[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// GetUser returns the user that owns the API key.
+func (c *ApiKeyClient) GetUser() (*User, error) {
+
+	code, body, err := c.Request("GET", "user", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	user := &User{}
+	err = json.Unmarshal(body, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetAuth returns the auth method and scopes of the API key.
+func (c *ApiKeyClient) GetAuth() (*Auth, error) {
+
+	code, body, err := c.Request("GET", "user/auth", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", code)
+	}
+
+	auth := &Auth{}
+	err = json.Unmarshal(body, auth)
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}